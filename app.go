@@ -1,13 +1,18 @@
-package main
+package pgmigrate
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -16,8 +21,9 @@ import (
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const defaultFilePermission = 0644
@@ -26,19 +32,178 @@ const defaultDirPermission = 0755
 //Config holds the migration config parameters
 type Config struct {
 	DbHost             string `json:"dbHost"`
+	DbPort             int    `json:"dbPort"`
 	DbName             string `json:"dbName"`
 	DbUsername         string `json:"dbUsername"`
 	DbPassword         string `json:"dbPassword"`
 	MigrationTableName string `json:"migrationTableName"`
+	//TimestampColumnType is the SQL type of the changelog timestamp column, BIGINT or NUMERIC,
+	//or TEXT or VARCHAR for existing changelog tables that store the version as text
+	TimestampColumnType string `json:"timestampColumnType"`
+	//SslMode is the libpq sslmode, disable by default
+	SslMode string `json:"sslMode"`
+	//SslCert, SslKey and SslRootCert are paths to the client certificate, its key
+	//and the root certificate used for mutual TLS
+	SslCert     string `json:"sslCert"`
+	SslKey      string `json:"sslKey"`
+	SslRootCert string `json:"sslRootCert"`
+	//TablePrefix is prepended to the changelog table names and replaces ${prefix} in migrations
+	TablePrefix string `json:"tablePrefix"`
+	//Keepalives enables TCP keepalives on database connections, true when not set
+	Keepalives *bool `json:"keepalives"`
+	//KeepalivesIdle is the number of idle seconds before the first keepalive probe
+	KeepalivesIdle int `json:"keepalivesIdle"`
+	//KeepalivesInterval is the number of seconds between keepalive probes
+	KeepalivesInterval int `json:"keepalivesInterval"`
+	//MaxConnectRetries is how many times connecting is retried while the database is not
+	//reachable yet, 0 to fail straight away
+	MaxConnectRetries int `json:"maxConnectRetries"`
+	//ConnectRetryDelay is the number of milliseconds before the first retry, doubling after
+	//each one, 500 when not set
+	ConnectRetryDelay int `json:"connectRetryDelay"`
+	//FunctionsTableName is the table recording the checksum of each function run
+	FunctionsTableName string `json:"functionsTableName"`
+	//Environment is the name of the environment migrations run in, overridden by --env
+	Environment string `json:"environment"`
+	//ShadowDsn is the connection string of a scratch database used by preview
+	ShadowDsn string `json:"shadowDsn"`
+	//ScriptsDir is the directory holding the migrations and the functions folder, ./scripts
+	//when not set
+	ScriptsDir string `json:"scriptsDir"`
+	//DatabaseUrl is a postgres:// URL used instead of the individual connection fields,
+	//overridden by the DATABASE_URL environment variable
+	DatabaseUrl string `json:"databaseUrl"`
+	//ChangelogDsn is the connection string of the database holding the changelog tables,
+	//the migrated database when not set
+	ChangelogDsn string `json:"changelogDsn"`
+	//ProtectedBaseline is the timestamp of the oldest migration down is not allowed to undo
+	ProtectedBaseline int64 `json:"protectedBaseline"`
+	//MaxMissingFiles is how many applied migrations may have no file before up and down
+	//refuse to run, 10 when not set
+	MaxMissingFiles *int `json:"maxMissingFiles"`
+	//CreateTableRetries is how many times creating the changelog tables is retried when a
+	//concurrent run creates them at the same time, 5 when not set
+	CreateTableRetries *int `json:"createTableRetries"`
+	//LockTimeout is how many seconds a run waits for another run holding the migration
+	//lock, 60 when not set
+	LockTimeout *int `json:"lockTimeout"`
+	//DriftCheck makes up check that applied migrations were not edited, which reads the
+	//file of every applied migration, true when not set
+	DriftCheck *bool `json:"driftCheck"`
+	//OutOfOrder is what up does with a pending migration older than the latest applied one:
+	//strict fails with ErrOutOfOrder, allow applies it and skip leaves it pending. strict
+	//when not set
+	OutOfOrder string `json:"outOfOrder"`
+	//Vars are the variables migration scripts are rendered with, overridden by --var
+	Vars map[string]string `json:"vars"`
 }
 
+//DefaultConfigFile is the config file read when Options.ConfigFile is not set
+const DefaultConfigFile = "pgmigrate.json"
+
+//DefaultScriptsDir is the scripts directory used when scriptsDir is not set in the config
+const DefaultScriptsDir = "./scripts"
+
+const defaultTimestampColumnType = "BIGINT"
+const defaultMaxMissingFiles = 10
+const defaultCreateTableRetries = 5
+const defaultLockTimeout = 60
+const defaultSslMode = "disable"
+const defaultConnectRetryDelay = 500
+const defaultOutOfOrder = "strict"
+const defaultDbHost = "localhost"
+const defaultDbPort = 5432
+const defaultMigrationTableName = "changelog"
+const defaultFunctionsTableName = "functions_changelog"
+
+var identifierRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+//ChangelogTable returns the name of the migration changelog table including the table prefix
+func (c *Config) ChangelogTable() string {
+	if stream != "" {
+		return c.TablePrefix + c.MigrationTableName + "_" + stream
+	}
+	return c.TablePrefix + c.MigrationTableName
+}
+
+//TimestampColumn returns the expression used to compare the changelog timestamp column with a
+//migration timestamp. Text columns are cast to NUMERIC so that versions such as '0001' still match.
+func (c *Config) TimestampColumn() string {
+	switch c.TimestampColumnType {
+	case "TEXT", "VARCHAR":
+		return "CAST(timestamp AS NUMERIC)"
+	default:
+		return "timestamp"
+	}
+}
+
+//FunctionsChangelogTable returns the name of the functions changelog table including the table prefix
+func (c *Config) FunctionsChangelogTable() string {
+	return c.TablePrefix + c.FunctionsTableName
+}
+
+//quotedChangelogTable returns the changelog table name quoted for use in SQL. It is
+//lower cased first, as postgres does with the unquoted names used by older versions, so
+//existing tables with upper case letters in their configured name are still found.
+func (c *Config) quotedChangelogTable() string {
+	return pq.QuoteIdentifier(strings.ToLower(c.ChangelogTable()))
+}
+
+//quotedFunctionsChangelogTable returns the functions changelog table name quoted for use in SQL
+func (c *Config) quotedFunctionsChangelogTable() string {
+	return pq.QuoteIdentifier(strings.ToLower(c.FunctionsChangelogTable()))
+}
+
+//timestampColumnTypes lists the supported types for the changelog timestamp column
+var timestampColumnTypes = []string{"BIGINT", "NUMERIC", "TEXT", "VARCHAR"}
+
+//outOfOrderPolicies lists the values of outOfOrder
+var outOfOrderPolicies = []string{"strict", "allow", "skip"}
+
 //Migration encapsulates a migration
 type Migration struct {
+	Filename    string
 	Description string
 	Timestamp   int64
 	DoScript    string
 	UndoScript  string
-	IsApplied   bool
+	//Schema is set by a -- @SCHEMA header and becomes the search_path the scripts run with
+	Schema string
+	//Environments is set by a -- @ENVIRONMENTS header and limits where the migration is applied
+	Environments []string
+	//Idempotent is set by a -- @IDEMPOTENT header, a unique violation while applying the
+	//migration then means its rows are already there
+	Idempotent bool
+	//NoTransaction is set by a -- @NO_TRANSACTION or -- @NO-TRANSACTION header for scripts
+	//that cannot run in a transaction, such as CREATE INDEX CONCURRENTLY
+	NoTransaction bool
+	//Metadata holds the -- @KEY value lines of the comment block the migration starts
+	//with, such as -- @AUTHOR or -- @TICKET, keyed by the lower case key
+	Metadata  map[string]string
+	IsApplied bool
+
+	//rawDoScript and rawUndoScript include the marker lines, as checksummed by older versions
+	rawDoScript   string
+	rawUndoScript string
+}
+
+//Author returns the -- @AUTHOR of the migration, "" if it has none
+func (m *Migration) Author() string {
+	return m.Metadata["author"]
+}
+
+//AllowedIn checks if the migration may be applied in the environment env. Migrations
+//without an @ENVIRONMENTS header are allowed everywhere.
+func (m *Migration) AllowedIn(env string) bool {
+	if len(m.Environments) == 0 {
+		return true
+	}
+	for _, e := range m.Environments {
+		if e == env {
+			return true
+		}
+	}
+	return false
 }
 
 //Function encapsulates a function
@@ -46,31 +211,33 @@ type Function struct {
 	Description    string
 	Timestamp      int64
 	FunctionScript string
+	//Depends lists the timestamps of the functions named in -- @DEPENDS headers, which are run first
+	Depends []int64
 }
 
-//WriteToFile writes migration to file
-func (m *Function) WriteToFile() error {
+//WriteToFile writes the function to file and returns its absolute path
+func (m *Function) WriteToFile() (string, error) {
 	tpl, err := template.New("FunctionTemplate").Parse(functionTpl)
 	if err != nil {
-		return err
+		return "", err
 	}
 	var templ bytes.Buffer
 	tpl.Execute(&templ, m)
 	templBytes := templ.Bytes()
-	templAbsPath, err := filepath.Abs(".")
+	templAbsPath, err := filepath.Abs(FunctionsDir())
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	tempPathNames := strings.Split(m.Description, " ")
-	templPath := templAbsPath + "/scripts/functions/" + strconv.FormatInt(m.Timestamp, 10) + "_" + strings.Join(tempPathNames, "_") + ".sql"
+	templPath := templAbsPath + "/" + strconv.FormatInt(m.Timestamp, 10) + "_" + strings.Join(tempPathNames, "_") + ".sql"
 
 	err = ioutil.WriteFile(templPath, templBytes, defaultFilePermission)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return templPath, nil
 }
 
 //Migrations is a slice of migrations
@@ -106,10 +273,10 @@ func (ms Functions) Len() int {
 
 var migrationTpl = `-- {{.Description}} --
 -- @DO sql script --
-
+{{.DoScript}}
 
 -- @UNDO sql script --
-
+{{.UndoScript}}
 
 `
 
@@ -126,495 +293,2619 @@ as $$
 $$;
 `
 
-//Do runs the function script
-func (m *Function) RunFunction() {
-	ExecuteSQL(m.FunctionScript)
+//RunFunction runs the function script and records its checksum
+func (m *Function) RunFunction(ctx context.Context) error {
+	c := GetConfig()
+	if err := ExecuteSQL(ctx, m.FunctionScript); err != nil {
+		return fmt.Errorf("function %d %s failed: %v", m.Timestamp, m.Description, err)
+	}
+
+	upsertSQL := fmt.Sprintf("INSERT INTO %s (timestamp, description, checksum) VALUES ($1, $2, $3) ON CONFLICT (timestamp) DO UPDATE SET description = EXCLUDED.description, checksum = EXCLUDED.checksum, applied_at = now()", c.quotedFunctionsChangelogTable())
+	if sqlOnly {
+		printSQL(upsertSQL, m.Timestamp, m.Description, m.Checksum())
+		return nil
+	}
+	_, err := getChangelogDb().ExecContext(ctx, upsertSQL, m.Timestamp, m.Description, m.Checksum())
+	return err
+}
+
+//Checksum returns the hex encoded SHA-256 checksum of the function script
+func (m *Function) Checksum() string {
+	sum := sha256.Sum256([]byte(m.FunctionScript))
+	return hex.EncodeToString(sum[:])
 }
 
 //Do runs the do script
-func (m *Migration) Do() {
+func (m *Migration) Do(ctx context.Context) error {
 	c := GetConfig()
-	ExecuteSQL(m.DoScript)
-
-	insertSQL := fmt.Sprintf("INSERT INTO %s (timestamp, description) VALUES ($1, $2)", c.MigrationTableName)
-	db := getDb()
-	_, err := db.Exec(insertSQL, m.Timestamp, m.Description)
+	insertSQL := fmt.Sprintf("INSERT INTO %s (timestamp, description, checksum, author) VALUES ($1, $2, $3, $4)", c.quotedChangelogTable())
+	err := runMigrationScript(ctx, m, m.DoScript, insertSQL, m.Timestamp, m.Description, m.Checksum(), nullIfEmpty(m.Author()))
 	if err != nil {
-		log.Fatalln(err)
+		return &MigrationError{Migration: *m, Err: err}
+	}
+	return nil
+}
+
+//Checksum returns the hex encoded SHA-256 checksum of the migration's scripts
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.DoScript + m.UndoScript))
+	return hex.EncodeToString(sum[:])
+}
+
+//legacyChecksum returns the checksum recorded by versions that kept the @DO and @UNDO
+//marker lines in the scripts, or "" if the migration was not read from a file
+func (m *Migration) legacyChecksum() string {
+	if m.rawDoScript == "" && m.rawUndoScript == "" {
+		return ""
 	}
+	sum := sha256.Sum256([]byte(m.rawDoScript + m.rawUndoScript))
+	return hex.EncodeToString(sum[:])
 }
 
 //Undo runs the undo script
-func (m *Migration) Undo() {
+func (m *Migration) Undo(ctx context.Context) error {
 	c := GetConfig()
-	ExecuteSQL(m.UndoScript)
-
-	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE timestamp = $1", c.MigrationTableName)
-	_, err := db.Exec(deleteSQL, m.Timestamp)
+	//@IDEMPOTENT only excuses unique violations while applying
+	undo := *m
+	undo.Idempotent = false
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", c.quotedChangelogTable(), c.TimestampColumn())
+	err := runMigrationScript(ctx, &undo, m.UndoScript, deleteSQL, m.Timestamp)
 	if err != nil {
-		log.Fatalln(err)
+		return &MigrationError{Migration: *m, Err: err}
 	}
+	return nil
 }
 
-//WriteToFile writes migration to file
-func (m *Migration) WriteToFile() error {
+//WriteToFile writes migration to file and returns its absolute path
+func (m *Migration) WriteToFile() (string, error) {
 	tpl, err := template.New("MigrationTemplate").Parse(migrationTpl)
 	if err != nil {
-		return err
+		return "", err
 	}
 	var templ bytes.Buffer
 	tpl.Execute(&templ, m)
 	templBytes := templ.Bytes()
-	templAbsPath, err := filepath.Abs(".")
+	dir, err := filepath.Abs(MigrationsDir())
 	if err != nil {
-		return err
+		return "", err
+	}
+	err = os.MkdirAll(dir, defaultDirPermission)
+	if err != nil {
+		return "", err
 	}
 
 	tempPathNames := strings.Split(m.Description, " ")
-	templPath := templAbsPath + "/scripts/" + strconv.FormatInt(m.Timestamp, 10) + "_" + strings.Join(tempPathNames, "_") + ".sql"
+	templPath := dir + "/" + strconv.FormatInt(m.Timestamp, 10) + "_" + strings.Join(tempPathNames, "_") + ".sql"
 
 	err = ioutil.WriteFile(templPath, templBytes, defaultFilePermission)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return templPath, nil
 }
 
 var db *sql.DB
 
-//MustReadConfig reads config file or exits in case of error
-func MustReadConfig() *Config {
-	configPath, err := filepath.Abs("./pgmigrate.json")
-	if err != nil {
-		log.Fatalln(err)
-	}
-	configBytes, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		log.Fatalln(err)
+//environment is the environment selected with --env
+var environment string
+
+//ActiveEnvironment returns the environment selected with --env, or the one set in the config
+func ActiveEnvironment() string {
+	if environment != "" {
+		return environment
 	}
-	var c Config
-	json.Unmarshal(configBytes, &c)
-	return &c
+	return GetConfig().Environment
 }
 
-var conf *Config
+//sqlOnly makes pgmigrate print every statement it would run instead of executing it
+var sqlOnly bool
 
-//GetConfig gets the configuration, reads from file if the configuration was not already loaded
-func GetConfig() *Config {
-	if conf == nil {
-		c := MustReadConfig()
-		conf = c
+//dryRun makes up and down read the changelog over a read-only session and print the
+//scripts and changelog statements of the migrations they would apply or undo
+var dryRun bool
+
+//stream selects an independent migration stream with its own changelog table and
+//scripts directory, set with --stream
+var stream string
+
+//MigrationsDir returns the directory holding the migration scripts of the selected stream
+func MigrationsDir() string {
+	if stream != "" {
+		return filepath.Join(fileConfig().ScriptsDir, stream) + "/"
 	}
-	return conf
+	return filepath.Join(fileConfig().ScriptsDir) + "/"
 }
 
-//Creates a db connection if one was not created before.
-func getDb() *sql.DB {
-	c := GetConfig()
-	if db == nil {
-		connStr := fmt.Sprintf("dbname=%s user=%s password=%s sslmode=disable", c.DbName, c.DbUsername, c.DbPassword)
-		newDb, err := sql.Open("postgres", connStr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		db = newDb
+//FunctionsDir returns the directory holding the function scripts
+func FunctionsDir() string {
+	return filepath.Join(fileConfig().ScriptsDir, "functions") + "/"
+}
+
+//jsonLogs streams a JSON progress event to stderr as each migration starts and finishes
+var jsonLogs bool
+
+//configFile is the path of the config file, set with --config
+var configFile = DefaultConfigFile
+
+//dsn replaces the connection details from the config file when set with --dsn
+var dsn string
+
+//readOnly makes every session read-only, for running status and history against a replica
+var readOnly bool
+
+//verbose logs every statement before it is executed and how long it took
+var verbose bool
+
+//table replaces migrationTableName from the config file when set with --table
+var table string
+
+//vars are the template variables set with --var, overriding those in the config
+var vars map[string]string
+
+//Options holds the settings given on the pgmigrate command line
+type Options struct {
+	//ConfigFile is the path of the config file, DefaultConfigFile when empty
+	ConfigFile string
+	//Dsn replaces the connection details from the config file
+	Dsn string
+	//ReadOnly makes every session read-only
+	ReadOnly bool
+	//Verbose logs every statement before it is executed
+	Verbose bool
+	//SQLOnly prints every statement that would run instead of executing it
+	SQLOnly bool
+	//DryRun prints what up and down would run against the current changelog without
+	//changing the database
+	DryRun bool
+	//JSONLogs streams a JSON progress event to stderr for each migration
+	JSONLogs bool
+	//Stream selects an independent migration stream
+	Stream string
+	//Environment is the environment migrations run in, overriding the config
+	Environment string
+	//Table is the changelog table name, overriding migrationTableName in the config
+	Table string
+	//Vars are template variables for migration scripts, overriding vars in the config
+	Vars map[string]string
+}
+
+//SetOptions applies the command line settings, it must be called before any command runs
+func SetOptions(o Options) {
+	configFile = DefaultConfigFile
+	if o.ConfigFile != "" {
+		configFile = o.ConfigFile
 	}
-	return db
+	dsn = o.Dsn
+	readOnly = o.ReadOnly
+	verbose = o.Verbose
+	sqlOnly = o.SQLOnly
+	dryRun = o.DryRun
+	jsonLogs = o.JSONLogs
+	stream = o.Stream
+	environment = o.Environment
+	table = o.Table
+	vars = o.Vars
 }
 
-//ExecuteSQL executes a query without parameters
-func ExecuteSQL(query string) {
-	db := getDb()
-	_, err := db.Exec(query)
+//MustReadConfig reads config file or exits in case of error
+func MustReadConfig() *Config {
+	c, err := ReadConfig()
 	if err != nil {
 		log.Fatalln(err)
-		return
 	}
+	return c
 }
 
-//IsMigrationApplied checks if a migration is already applied
-func IsMigrationApplied(m *Migration) bool {
-	var count int
-	conf := GetConfig()
-	db := getDb()
-	err := db.QueryRow("SELECT COUNT(*) as count FROM "+conf.MigrationTableName+" WHERE timestamp = $1", m.Timestamp).Scan(&count)
+//ReadConfig reads the config file, applies the environment overrides and defaults and
+//checks the values
+func ReadConfig() (*Config, error) {
+	configPath, err := filepath.Abs(configFile)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-
-	if count > 0 {
-		return true
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
 	}
-	return false
+	var c Config
+	err = json.Unmarshal(configBytes, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
+	err = applyEnvOverrides(&c)
+	if err != nil {
+		return nil, err
+	}
+	if table != "" {
+		c.MigrationTableName = table
+	}
+	err = c.applyDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if stream != "" && (!identifierRe.MatchString(stream) || stream == "functions") {
+		return nil, fmt.Errorf("Invalid stream %q, only letters, digits and underscores are allowed and functions is reserved", stream)
+	}
+	return &c, nil
 }
 
-//SetMigrationStatus marks migration as either applied or not
-func SetMigrationStatus(m *Migration) {
-	if IsMigrationApplied(m) {
-		m.IsApplied = true
+//applyDefaults fills in the fields left empty and checks the values that have a fixed form
+func (c *Config) applyDefaults() error {
+	if c.TimestampColumnType == "" {
+		c.TimestampColumnType = defaultTimestampColumnType
+	}
+	c.TimestampColumnType = strings.ToUpper(c.TimestampColumnType)
+	if !isTimestampColumnType(c.TimestampColumnType) {
+		return fmt.Errorf("Invalid timestampColumnType %q, must be one of %s", c.TimestampColumnType, strings.Join(timestampColumnTypes, ", "))
+	}
+	if c.SslMode == "" {
+		c.SslMode = defaultSslMode
+	}
+	if c.OutOfOrder == "" {
+		c.OutOfOrder = defaultOutOfOrder
+	}
+	if !isOutOfOrderPolicy(c.OutOfOrder) {
+		return fmt.Errorf("Invalid outOfOrder %q, must be one of %s", c.OutOfOrder, strings.Join(outOfOrderPolicies, ", "))
+	}
+	if c.FunctionsTableName == "" {
+		c.FunctionsTableName = defaultFunctionsTableName
+	}
+	if c.ScriptsDir == "" {
+		c.ScriptsDir = DefaultScriptsDir
+	}
+	if c.TablePrefix != "" && !identifierRe.MatchString(c.TablePrefix) {
+		return fmt.Errorf("Invalid tablePrefix %q, only letters, digits and underscores are allowed", c.TablePrefix)
 	}
+	//the table names end up in SQL, so only plain identifiers are accepted
+	if c.MigrationTableName != "" && !identifierRe.MatchString(c.MigrationTableName) {
+		return fmt.Errorf("Invalid migrationTableName %q, only letters, digits and underscores are allowed", c.MigrationTableName)
+	}
+	if !identifierRe.MatchString(c.FunctionsTableName) {
+		return fmt.Errorf("Invalid functionsTableName %q, only letters, digits and underscores are allowed", c.FunctionsTableName)
+	}
+	return nil
 }
 
-//ReadMigration reads a migration from file
-func ReadMigration(filename string) *Migration {
-	migrationBytes, err := ioutil.ReadFile("./scripts/" + filename)
-	if err != nil {
-		log.Fatalln(err)
+//envOverrides maps environment variables to the config fields they override
+var envOverrides = []struct {
+	name  string
+	field func(c *Config) *string
+}{
+	{"PGMIGRATE_DB_HOST", func(c *Config) *string { return &c.DbHost }},
+	{"PGMIGRATE_DB_NAME", func(c *Config) *string { return &c.DbName }},
+	{"PGMIGRATE_DB_USERNAME", func(c *Config) *string { return &c.DbUsername }},
+	{"PGMIGRATE_DB_PASSWORD", func(c *Config) *string { return &c.DbPassword }},
+	{"PGMIGRATE_MIGRATION_TABLE", func(c *Config) *string { return &c.MigrationTableName }},
+}
+
+//applyEnvOverrides replaces config values with the PGMIGRATE_* environment variables that are set
+func applyEnvOverrides(c *Config) error {
+	for _, o := range envOverrides {
+		if v, ok := os.LookupEnv(o.name); ok {
+			*o.field(c) = v
+		}
 	}
-	migrationStr := string(migrationBytes)
-	lines := strings.Split(migrationStr, "\n")
-	var doScript string
-	var undoScript string
-	doing := true
-	for _, line := range lines {
-		if strings.Contains(line, "-- @DO") {
-			doing = true
+	if v, ok := os.LookupEnv("PGMIGRATE_DB_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Invalid PGMIGRATE_DB_PORT %q", v)
 		}
-		if strings.Contains(line, "-- @UNDO") {
-			doing = false
+		c.DbPort = port
+	}
+	return nil
+}
+
+//Validate checks that the required config fields are set, listing every missing one. The
+//connection fields are not required when a database URL or --dsn is given instead.
+func (c *Config) Validate() error {
+	var missing []string
+	if dsn == "" && c.DatabaseUrl == "" && os.Getenv("DATABASE_URL") == "" {
+		if c.DbName == "" {
+			missing = append(missing, "dbName")
 		}
-		if doing {
-			doScript = doScript + line + "\n"
-		} else {
-			undoScript = undoScript + line + "\n"
+		if c.DbUsername == "" {
+			missing = append(missing, "dbUsername")
 		}
 	}
+	if c.MigrationTableName == "" {
+		missing = append(missing, "migrationTableName")
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s is required in %s", missing[0], configFile)
+	default:
+		return fmt.Errorf("%s and %s are required in %s", strings.Join(missing[:len(missing)-1], ", "), missing[len(missing)-1], configFile)
+	}
+}
 
-	//get the timestamp part
-	re := regexp.MustCompile("[0-9]+")
-	matches := re.FindAllString(filename, 1)
-
-	var timestamp int64
-	if len(matches) > 0 {
-		timestamp, err = strconv.ParseInt(matches[0], 10, 64)
-		if err != nil {
-			log.Fatalln(err)
+//isTimestampColumnType checks if t is a supported timestamp column type
+func isTimestampColumnType(t string) bool {
+	for _, ct := range timestampColumnTypes {
+		if t == ct {
+			return true
 		}
-	} else {
-		log.Fatalln("Invalid migration file name")
 	}
+	return false
+}
 
-	reDescription := regexp.MustCompile("[a-zA-Z]+")
-
-	descMatches := reDescription.FindAllString(filename, 10)
+func isOutOfOrderPolicy(p string) bool {
+	for _, policy := range outOfOrderPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
 
-	//remove the last bit i.e sql in file name
-	descMatches = descMatches[:len(descMatches)-1]
+var conf *Config
 
-	description := strings.Join(descMatches, " ")
+//unvalidatedConf is the config read by fileConfig before GetConfig has been called
+var unvalidatedConf *Config
 
-	m := Migration{
-		Description: description,
-		Timestamp:   timestamp,
-		DoScript:    doScript,
-		UndoScript:  undoScript,
+//fileConfig gets the configuration for working with the script files, which unlike
+//GetConfig does not require the connection settings
+func fileConfig() *Config {
+	if conf != nil {
+		return conf
 	}
+	if unvalidatedConf == nil {
+		unvalidatedConf = MustReadConfig()
+	}
+	return unvalidatedConf
+}
 
-	SetMigrationStatus(&m)
-
-	return &m
+//GetConfig gets the configuration, reads from file if the configuration was not already loaded
+func GetConfig() *Config {
+	if conf == nil {
+		c := MustReadConfig()
+		if err := c.Validate(); err != nil {
+			log.Fatalln(err)
+		}
+		conf = c
+	}
+	return conf
 }
 
-//ReadFunction reads a function from file
-func ReadFunction(filename string) *Function {
-	functionBytes, err := ioutil.ReadFile("./scripts/functions/" + filename)
-	if err != nil {
-		log.Fatalln(err)
+//quoteConnValue quotes a connection string value if it is empty or contains
+//characters that libpq would otherwise treat as separators
+func quoteConnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " '\\") {
+		return v
 	}
-	functionScript := string(functionBytes)
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "'", "\\'", -1)
+	return "'" + v + "'"
+}
 
-	//get the timestamp part
-	re := regexp.MustCompile("[0-9]+")
-	matches := re.FindAllString(filename, 1)
+//connectionString builds the libpq connection string from the config
+func connectionString(c *Config) string {
+	host := c.DbHost
+	if host == "" {
+		host = defaultDbHost
+	}
+	port := c.DbPort
+	if port == 0 {
+		port = defaultDbPort
+	}
+	params := []string{
+		"host=" + quoteConnValue(host),
+		"port=" + strconv.Itoa(port),
+		"dbname=" + quoteConnValue(c.DbName),
+		"user=" + quoteConnValue(c.DbUsername),
+		"password=" + quoteConnValue(c.DbPassword),
+		"sslmode=" + quoteConnValue(c.SslMode),
+	}
+	certs := []struct {
+		key  string
+		path string
+	}{
+		{"sslcert", c.SslCert},
+		{"sslkey", c.SslKey},
+		{"sslrootcert", c.SslRootCert},
+	}
+	for _, cert := range certs {
+		if cert.path != "" {
+			params = append(params, cert.key+"="+quoteConnValue(cert.path))
+		}
+	}
+	return strings.Join(params, " ")
+}
 
-	var timestamp int64
-	if len(matches) > 0 {
-		timestamp, err = strconv.ParseInt(matches[0], 10, 64)
+//readOnlyConnectionString adds default_transaction_read_only to a connection string, which
+//lib/pq sends to the server as a session setting
+func readOnlyConnectionString(connStr string) (string, error) {
+	if isDatabaseURL(connStr) {
+		var err error
+		connStr, err = parseDatabaseURL(connStr)
 		if err != nil {
-			log.Fatalln(err)
+			return "", err
 		}
-	} else {
-		log.Fatalln("Invalid function file name")
 	}
+	return connStr + " default_transaction_read_only=on", nil
+}
 
-	reDescription := regexp.MustCompile("[a-zA-Z]+")
-
-	descMatches := reDescription.FindAllString(filename, 10)
-
-	//remove the last bit i.e sql in file name
-	descMatches = descMatches[:len(descMatches)-1]
-
-	description := strings.Join(descMatches, " ")
+//isDatabaseURL reports whether connStr is a postgres:// URL rather than key=value pairs
+func isDatabaseURL(connStr string) bool {
+	return strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://")
+}
 
-	f := Function{
-		Description:    description,
-		Timestamp:      timestamp,
-		FunctionScript: functionScript,
+//parseDatabaseURL converts a postgres:// URL to a connection string. The URL holds the
+//password, so an error parsing it does not repeat it.
+func parseDatabaseURL(rawURL string) (string, error) {
+	connStr, err := pq.ParseURL(rawURL)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "", errors.New("invalid database URL, check that special characters in the password are percent-encoded")
 	}
+	return connStr, err
+}
 
-	return &f
+//checkSslFiles confirms the configured certificate files exist
+func checkSslFiles(c *Config) {
+	files := []struct {
+		name string
+		path string
+	}{
+		{"sslCert", c.SslCert},
+		{"sslKey", c.SslKey},
+		{"sslRootCert", c.SslRootCert},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			log.Fatalf("Unable to read %s %s: %v", f.name, f.path, err)
+		}
+	}
 }
 
-func ReadFunctionsFromFile() Functions {
-	fis, err := ioutil.ReadDir("./scripts/functions/")
+//databaseURL returns the DATABASE_URL environment variable or the databaseUrl from the
+//config, converted to a connection string, or an empty string if neither is set
+func databaseURL(c *Config) string {
+	rawURL := os.Getenv("DATABASE_URL")
+	if rawURL == "" {
+		rawURL = c.DatabaseUrl
+	}
+	if rawURL == "" {
+		return ""
+	}
+	connStr, err := parseDatabaseURL(rawURL)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	return connStr
+}
 
-	var ms Functions
-	for _, f := range fis {
-		mig := ReadFunction(f.Name())
-		ms = append(ms, *mig)
-	}
-	sort.Sort(ms)
-	return ms
+//SetDB makes the commands use pool, e.g. an application's own connection pool, instead of
+//opening a connection from the config. The changelog tables are kept in pool as well
+//unless changelogDsn is set.
+func SetDB(pool *sql.DB) {
+	db = pool
 }
 
-//ReadMigrationsFromFile reads all migrations from files
-func ReadMigrationsFromFile() Migrations {
-	fis, err := ioutil.ReadDir("./scripts/")
+//Creates a db connection if one was not created before.
+func getDb() *sql.DB {
+	pool, err := getDbContext(context.Background())
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	var ms Migrations
-	for _, f := range fis {
-		if !f.IsDir() {
-			mig := ReadMigration(f.Name())
-			ms = append(ms, *mig)
-		}
-	}
-	sort.Sort(ms)
-	return ms
+	return pool
 }
 
-func main() {
-
-	if len(os.Args) > 1 {
-		command := os.Args[1]
-
-		switch command {
-		case "init":
-			InitMigration()
-		case "new":
-			NewMigration()
-		case "function":
-			NewFunction()
-		case "run-functions":
-			RunFunctions()
-		case "up":
-			Up()
-		case "down":
-			Down()
-		case "status":
-			Status()
-		default:
-			log.Fatalln("Invalid command.")
+//getDbContext is getDb returning an error, waiting for the database with ctx so the
+//connect retries stop when it is cancelled
+func getDbContext(ctx context.Context) (*sql.DB, error) {
+	c := GetConfig()
+	if db == nil {
+		connStr := dsn
+		if connStr == "" {
+			connStr = databaseURL(c)
 		}
-	} else {
-		fmt.Println("usage: pgmigrate <command> <params>")
+		if connStr == "" {
+			checkSslFiles(c)
+			connStr = connectionString(c)
+		}
+		pool, err := openDb(ctx, c, connStr)
+		if err != nil {
+			return nil, err
+		}
+		db = pool
 	}
+	return db, nil
 }
 
-//InitMigration creates migration directory, config.js and initial migration
-func InitMigration() {
+var changelogDb *sql.DB
 
-	if len(os.Args) < 2 {
-		log.Fatalln("Missing parameters. Usage: pgmigrate init <path>")
+//getChangelogDb returns the connection used for the changelog tables, which is the
+//changelogDsn database when one is configured and the migrated database otherwise
+func getChangelogDb() *sql.DB {
+	pool, err := getChangelogDbContext(context.Background())
+	if err != nil {
+		log.Fatalln(err)
 	}
+	return pool
+}
 
-	migrationPath := "."
-	if len(os.Args) > 2 {
-		migrationPath = os.Args[2]
+//getChangelogDbContext is getChangelogDb returning an error, waiting for the database
+//with ctx
+func getChangelogDbContext(ctx context.Context) (*sql.DB, error) {
+	c := GetConfig()
+	if c.ChangelogDsn == "" {
+		return getDbContext(ctx)
 	}
+	if changelogDb == nil {
+		pool, err := openDb(ctx, c, c.ChangelogDsn)
+		if err != nil {
+			return nil, err
+		}
+		changelogDb = pool
+	}
+	return changelogDb, nil
+}
 
-	migrationPath, err := filepath.Abs(migrationPath)
+//openDb opens a connection pool with the configured keepalives, read-only under --read-only
+//and --dry-run, and waits for the database to answer when connect retries are configured
+func openDb(ctx context.Context, c *Config, connStr string) (*sql.DB, error) {
+	if readOnly || dryRun {
+		var err error
+		connStr, err = readOnlyConnectionString(connStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialer := keepaliveDialer{
+		enabled:  c.Keepalives == nil || *c.Keepalives,
+		idle:     time.Duration(c.KeepalivesIdle) * time.Second,
+		interval: time.Duration(c.KeepalivesInterval) * time.Second,
+	}
+	connector, err := newDialerConnector(connStr, dialer)
 	if err != nil {
-		log.Fatalln("Unable to get absolute path: ", err)
+		return nil, err
 	}
-	fmt.Println("Initializing migrations at: ", migrationPath)
+	pool := sql.OpenDB(connector)
+	if c.MaxConnectRetries > 0 {
+		if err := waitForDb(ctx, c, pool); err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+//waitForDb pings the database until it answers, retrying with exponential backoff while
+//the server cannot be reached or is still starting up. It gives up with ctx's error as
+//soon as ctx is cancelled.
+func waitForDb(ctx context.Context, c *Config, pool *sql.DB) error {
+	delay := time.Duration(c.ConnectRetryDelay) * time.Millisecond
+	if delay <= 0 {
+		delay = defaultConnectRetryDelay * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		err := pool.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		//errors from a running server, such as a wrong password, are not worth retrying
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() != "cannot_connect_now" {
+			return connectError(ctx, err)
+		}
+		if attempt >= c.MaxConnectRetries {
+			return fmt.Errorf("%w after %d retries: %v", ErrConnect, c.MaxConnectRetries, err)
+		}
+		log.Printf("Database not ready (%v), retrying in %s", err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+//ExecuteSQL executes a query without parameters and returns any error
+func ExecuteSQL(ctx context.Context, query string) error {
+	if sqlOnly {
+		printSQL(query)
+		return nil
+	}
+	return execStatement(ctx, getDb(), query)
+}
+
+//runMigrationScript runs a migration's @DO or @UNDO script followed by record, the statement
+//that updates the changelog, in one transaction so that either both take effect or neither does. A
+//migration with a @NO_TRANSACTION header runs its statements one at a time outside of a
+//transaction instead, and when the changelog is kept in another database with changelogDsn
+//record runs there once the script has committed. A @SCHEMA header sets the search_path
+//the script runs with. Under --sql-only and --dry-run the statements are printed instead.
+func runMigrationScript(ctx context.Context, m *Migration, script string, record string, args ...interface{}) error {
+	setSQL := searchPathSQL(m)
+	sameDb := GetConfig().ChangelogDsn == ""
+
+	if sqlOnly || dryRun {
+		if m.NoTransaction {
+			if m.Schema != "" {
+				printSQL("SET search_path TO " + pq.QuoteIdentifier(m.Schema) + ";")
+			}
+			printSQL(script)
+			if m.Schema != "" {
+				printSQL("RESET search_path;")
+			}
+			printSQL(record, args...)
+			return nil
+		}
+		printSQL("BEGIN;")
+		if setSQL != "" {
+			printSQL(setSQL + ";")
+		}
+		printSQL(script)
+		if sameDb {
+			printSQL(record, args...)
+		}
+		printSQL("COMMIT;")
+		if !sameDb {
+			printSQL(record, args...)
+		}
+		return nil
+	}
+
+	if m.NoTransaction {
+		err := execStatements(ctx, m, script)
+		if err != nil {
+			return err
+		}
+		//the statements have run, so they are recorded even if ctx was cancelled meanwhile
+		return execStatement(context.Background(), getChangelogDb(), record, args...)
+	}
+
+	tx, err := getDb().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	logStatement("BEGIN")
+	err = execScriptInTx(ctx, tx, m, setSQL, script)
+	if err == nil && sameDb {
+		err = execStatement(ctx, tx, record, args...)
+	}
+	if err != nil {
+		logStatement("ROLLBACK")
+		tx.Rollback()
+		return err
+	}
+	logStatement("COMMIT")
+	err = tx.Commit()
+	if err != nil || sameDb {
+		return err
+	}
+	//the script has committed, so it is recorded even if ctx was cancelled meanwhile
+	return execStatement(context.Background(), getChangelogDb(), record, args...)
+}
+
+//searchPathSQL returns the statement setting the search_path of a migration's transaction
+//to its @SCHEMA, or "" if it has none
+func searchPathSQL(m *Migration) string {
+	if m.Schema == "" {
+		return ""
+	}
+	return "SET LOCAL search_path TO " + pq.QuoteIdentifier(m.Schema)
+}
+
+//execer is implemented by *sql.DB, *sql.Tx and *sql.Conn
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+//verboseMaxLength is how many bytes of a statement --verbose logs
+const verboseMaxLength = 500
+
+//logStatement logs a statement under --verbose, cut short after verboseMaxLength bytes
+func logStatement(query string) {
+	if !verbose {
+		return
+	}
+	query = strings.TrimSpace(query)
+	if len(query) > verboseMaxLength {
+		end := verboseMaxLength
+		//do not cut a multi-byte character in half
+		for end > 0 && !utf8.RuneStart(query[end]) {
+			end--
+		}
+		query = fmt.Sprintf("%s ... (%d more bytes)", query[:end], len(query)-end)
+	}
+	log.Println(query)
+}
+
+//execStatement executes a single statement, logging it and how long it took under --verbose
+func execStatement(ctx context.Context, e execer, record string, args ...interface{}) error {
+	logStatement(record)
+	start := time.Now()
+	_, err := e.ExecContext(ctx, record, args...)
+	if verbose {
+		if err != nil {
+			log.Printf("failed after %s", time.Since(start).Round(time.Millisecond))
+		} else {
+			log.Printf("took %s", time.Since(start).Round(time.Millisecond))
+		}
+	}
+	return err
+}
+
+//execScript executes the statements of a script one at a time, so that an error in any
+//of them is reported rather than lost in a multi-statement query
+func execScript(ctx context.Context, e execer, script string) error {
+	for _, statement := range SplitStatements(script) {
+		if statementKeyword(statement) == "" {
+			//blank or only comments
+			continue
+		}
+		if err := execStatement(ctx, e, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//execScriptInTx executes a migration script in tx. The script of an @IDEMPOTENT migration
+//runs under a savepoint so that a unique violation can be rolled back without aborting tx.
+func execScriptInTx(ctx context.Context, tx *sql.Tx, m *Migration, setSQL string, script string) error {
+	if setSQL != "" {
+		if err := execStatement(ctx, tx, setSQL); err != nil {
+			return err
+		}
+	}
+	if !m.Idempotent {
+		return execScript(ctx, tx, script)
+	}
+
+	if err := execStatement(ctx, tx, "SAVEPOINT idempotent_migration"); err != nil {
+		return err
+	}
+	err := execScript(ctx, tx, script)
+	if err != nil && isUniqueViolation(err) {
+		log.Printf("%s hit a unique violation, treating it as already applied: %v", m.Description, err)
+		err = execStatement(ctx, tx, "ROLLBACK TO SAVEPOINT idempotent_migration")
+	}
+	return err
+}
+
+//execStatements executes the statements of a @NO_TRANSACTION migration one at a time on a
+//single connection outside of a transaction, since statements such as CREATE INDEX
+//CONCURRENTLY refuse to run in one
+func execStatements(ctx context.Context, m *Migration, script string) error {
+	conn, err := getDb().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.Schema != "" {
+		setSQL := "SET search_path TO " + pq.QuoteIdentifier(m.Schema)
+		if err = execStatement(ctx, conn, setSQL); err != nil {
+			return err
+		}
+		//the connection goes back to the pool afterwards, so it is reset even if ctx was cancelled
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), "RESET search_path"); err != nil {
+				log.Printf("Unable to reset the search_path: %v", err)
+			}
+		}()
+	}
+	err = execScript(ctx, conn, script)
+	if err != nil && m.Idempotent && isUniqueViolation(err) {
+		log.Printf("%s hit a unique violation, treating it as already applied: %v", m.Description, err)
+		return nil
+	}
+	return err
+}
+
+//printSQL prints a statement to stdout, inlining any $n parameters as SQL literals
+func printSQL(query string, args ...interface{}) {
+	//replace the highest placeholders first so $1 does not clobber $10
+	for i := len(args); i > 0; i-- {
+		var literal string
+		switch v := args[i-1].(type) {
+		case string:
+			literal = pq.QuoteLiteral(v)
+		case nil:
+			literal = "NULL"
+		default:
+			literal = fmt.Sprint(v)
+		}
+		query = strings.Replace(query, "$"+strconv.Itoa(i), literal, -1)
+	}
+	query = strings.TrimSpace(query)
+	if len(args) > 0 && !strings.HasSuffix(query, ";") {
+		query += ";"
+	}
+	fmt.Println(query)
+	fmt.Println()
+}
+
+//nullIfEmpty returns s, or nil to store NULL if it is empty
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+//IsMigrationApplied checks if a migration is already applied
+func IsMigrationApplied(ctx context.Context, m *Migration) bool {
+	applied, err := isMigrationApplied(ctx, m)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return applied
+}
+
+//isMigrationApplied is IsMigrationApplied returning an error
+func isMigrationApplied(ctx context.Context, m *Migration) (bool, error) {
+	//--sql-only renders statements as if against a database with no migrations applied
+	if sqlOnly {
+		return false, nil
+	}
+	var count int
+	conf := GetConfig()
+	db := getChangelogDb()
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) as count FROM "+conf.quotedChangelogTable()+" WHERE "+conf.TimestampColumn()+" = $1", m.Timestamp).Scan(&count)
+	if isUndefinedTable(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+//isUndefinedTable checks if err is postgres reporting that a table does not exist
+func isUndefinedTable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code.Name() == "undefined_table"
+}
+
+//isUniqueViolation checks if err is postgres' unique_violation error (SQLSTATE 23505)
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+//AppliedTimestamps returns the timestamps of all migrations recorded in the changelog with a
+//single query. A missing changelog table means no migration has been applied.
+func AppliedTimestamps() map[int64]bool {
+	applied, err := appliedTimestamps(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return applied
+}
+
+//appliedTimestamps is AppliedTimestamps returning errors
+func appliedTimestamps(ctx context.Context) (map[int64]bool, error) {
+	applied := make(map[int64]bool)
+	//--sql-only renders statements as if against a database with no migrations applied
+	if sqlOnly {
+		return applied, nil
+	}
+	c := GetConfig()
+	rows, err := getChangelogDb().QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", c.TimestampColumn(), c.quotedChangelogTable()))
+	if err != nil {
+		if isUndefinedTable(err) {
+			return applied, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp int64
+		if err = rows.Scan(&timestamp); err != nil {
+			return nil, err
+		}
+		applied[timestamp] = true
+	}
+	return applied, rows.Err()
+}
+
+//SetMigrationStatus marks migration as either applied or not
+func SetMigrationStatus(m *Migration) {
+	if IsMigrationApplied(context.Background(), m) {
+		m.IsApplied = true
+	}
+}
+
+//markers may be written in any case and with or without a space after the dashes
+var doMarkerRe = regexp.MustCompile(`(?i)^\s*--\s*@DO\b`)
+var undoMarkerRe = regexp.MustCompile(`(?i)^\s*--\s*@UNDO\b`)
+
+//readScript reads a sql file, normalizing CRLF and CR line endings to LF so
+//parsing behaves the same regardless of the platform the file was written on
+func readScript(path string) (string, error) {
+	scriptBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	script := strings.Replace(string(scriptBytes), "\r\n", "\n", -1)
+	script = strings.Replace(script, "\r", "\n", -1)
+	return script, nil
+}
+
+var schemaRe = regexp.MustCompile(`^\s*-- @SCHEMA\s+(\S+)\s*$`)
+var environmentsRe = regexp.MustCompile(`^\s*-- @ENVIRONMENTS\s+(.+)$`)
+var idempotentRe = regexp.MustCompile(`^\s*-- @IDEMPOTENT\s*$`)
+var noTransactionRe = regexp.MustCompile(`^\s*-- @NO[-_]TRANSACTION\s*$`)
+var dependsRe = regexp.MustCompile(`^\s*-- @DEPENDS\s+(.+)$`)
+var includeRe = regexp.MustCompile(`^\s*-- @INCLUDE\s+(\S+)\s*$`)
+var templateRe = regexp.MustCompile(`^\s*-- @TEMPLATE\s*$`)
+var metadataRe = regexp.MustCompile(`^\s*--\s*@([A-Za-z][A-Za-z0-9_-]*)(?:\s+(.*?))?\s*$`)
+
+//directives are the -- @KEY lines pgmigrate acts on, which are not metadata
+var directives = map[string]bool{
+	"do": true, "undo": true, "schema": true, "environments": true, "idempotent": true,
+	"no_transaction": true, "no-transaction": true, "depends": true, "include": true,
+	"template": true,
+}
+
+//readMigrationScript reads a migration file with its includes inlined
+func readMigrationScript(filename string) (string, error) {
+	script, err := readScript(MigrationsDir() + filename)
+	if err != nil {
+		return "", err
+	}
+	return expandIncludes(script, []string{filepath.Clean(filename)})
+}
+
+//expandIncludes replaces every -- @INCLUDE <path> line with the contents of the file at
+//path, relative to the scripts directory. stack holds the files being expanded and is
+//used to detect include cycles.
+func expandIncludes(script string, stack []string) (string, error) {
+	lines := strings.Split(script, "\n")
+	var state sqlState
+	for i, line := range lines {
+		quoted := state.quoted()
+		state.scanLine(line)
+		if quoted {
+			continue
+		}
+		matches := includeRe.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		include := filepath.Clean(matches[1])
+		for _, f := range stack {
+			if f == include {
+				return "", fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), include)
+			}
+		}
+		included, err := readScript(MigrationsDir() + include)
+		if err != nil {
+			return "", fmt.Errorf("%s: unable to include %s: %v", stack[len(stack)-1], include, err)
+		}
+		included, err = expandIncludes(included, append(stack, include))
+		if err != nil {
+			return "", err
+		}
+		lines[i] = strings.TrimSuffix(included, "\n")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+//ReadMigration reads a migration from file along with whether it is applied
+func ReadMigration(filename string) (*Migration, error) {
+	m, err := loadMigration(filename)
+	if err != nil {
+		return nil, err
+	}
+	m.IsApplied, err = isMigrationApplied(context.Background(), m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//loadMigration reads and parses a migration file without checking whether it is applied
+func loadMigration(filename string) (*Migration, error) {
+	migrationStr, err := readMigrationContent(filename)
+	if err != nil {
+		return nil, err
+	}
+	migrationStr, err = renderMigrationTemplate(filename, migrationStr)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseMigration(filename, migrationStr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := GetConfig()
+	m.DoScript = strings.Replace(m.DoScript, "${prefix}", c.TablePrefix, -1)
+	m.UndoScript = strings.Replace(m.UndoScript, "${prefix}", c.TablePrefix, -1)
+	m.rawDoScript = strings.Replace(m.rawDoScript, "${prefix}", c.TablePrefix, -1)
+	m.rawUndoScript = strings.Replace(m.rawUndoScript, "${prefix}", c.TablePrefix, -1)
+
+	return m, nil
+}
+
+//templateVars returns the variables migration scripts are rendered with: Env, the active
+//environment, and the vars from the config and --var, which take precedence
+func templateVars() map[string]string {
+	data := map[string]string{"Env": environment}
+	if environment == "" {
+		data["Env"] = fileConfig().Environment
+	}
+	for k, v := range fileConfig().Vars {
+		data[k] = v
+	}
+	for k, v := range vars {
+		data[k] = v
+	}
+	return data
+}
+
+//renderMigrationTemplate renders a migration script through text/template with the
+//templateVars. Only scripts with a -- @TEMPLATE line are rendered, the rest are returned
+//untouched so literals such as '{{1,2}}' keep working, and a variable that is not set is
+//an error rather than an empty string.
+func renderMigrationTemplate(filename string, script string) (string, error) {
+	if !isTemplate(script) {
+		return script, nil
+	}
+	tpl, err := template.New(filename).Option("missingkey=error").Parse(script)
+	if err != nil {
+		return "", err
+	}
+	var rendered strings.Builder
+	if err := tpl.Execute(&rendered, templateVars()); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+//isTemplate reports whether script has a -- @TEMPLATE line
+func isTemplate(script string) bool {
+	for _, line := range strings.Split(script, "\n") {
+		if templateRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+var migrationFilenameRe = regexp.MustCompile(`^([0-9]+)_`)
+
+//checkScriptsDir returns an error wrapping ErrNoScriptsDir if dir does not exist, as
+//when pgmigrate runs in the wrong directory or before init
+func checkScriptsDir(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return fmt.Errorf("%w at %s, run 'pgmigrate init' first", ErrNoScriptsDir, dir)
+	}
+	return nil
+}
+
+//upSuffix and downSuffix end the names of the two files of a migration split into a file
+//holding its @DO script and one holding its @UNDO script
+const upSuffix = ".up.sql"
+const downSuffix = ".down.sql"
+
+//downFilename returns the .down.sql file paired with a .up.sql migration file, or "" if
+//filename is not a .up.sql file
+func downFilename(filename string) string {
+	if !strings.HasSuffix(filename, upSuffix) {
+		return ""
+	}
+	return strings.TrimSuffix(filename, upSuffix) + downSuffix
+}
+
+//readMigrationContent reads a migration file. The two files of a split migration, of which
+//filename is the .up.sql one, are joined into the single file form with @DO and @UNDO
+//markers. A missing .down.sql file reads as an empty @UNDO script.
+func readMigrationContent(filename string) (string, error) {
+	down := downFilename(filename)
+	if down == "" {
+		return readMigrationScript(filename)
+	}
+	doScript, err := readMigrationScript(filename)
+	if err != nil {
+		return "", err
+	}
+	undoScript, err := readMigrationScript(down)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return "-- @DO\n" + doScript + "\n-- @UNDO\n" + undoScript, nil
+}
+
+//migrationFiles lists the file of every migration in the scripts directory, which for a
+//split migration is its .up.sql file. A single file migration with the timestamp of a
+//split one is skipped with a warning, and a .down.sql file without its .up.sql file is
+//reported in the returned FileErrors.
+func migrationFiles() ([]string, FileErrors, error) {
+	if err := checkScriptsDir(MigrationsDir()); err != nil {
+		return nil, nil, err
+	}
+	fis, err := ioutil.ReadDir(MigrationsDir())
+	if err != nil {
+		return nil, nil, err
+	}
+	present := make(map[string]bool)
+	split := make(map[int64]string)
+	for _, f := range fis {
+		if !isScriptFile(f) {
+			continue
+		}
+		present[f.Name()] = true
+		if strings.HasSuffix(f.Name(), upSuffix) {
+			if timestamp, _, err := parseMigrationFilename(f.Name()); err == nil {
+				split[timestamp] = f.Name()
+			}
+		}
+	}
+
+	var files []string
+	var errs FileErrors
+	for _, f := range fis {
+		name := f.Name()
+		if !present[name] {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, downSuffix):
+			if !present[strings.TrimSuffix(name, downSuffix)+upSuffix] {
+				errs = append(errs, fmt.Errorf("%s has no matching %s file", name, upSuffix))
+			}
+		case strings.HasSuffix(name, upSuffix):
+			files = append(files, name)
+		default:
+			timestamp, _, err := parseMigrationFilename(name)
+			if up, ok := split[timestamp]; err == nil && ok {
+				log.Printf("Warning: %s and %s are both migration %d, using the %s and %s files", name, up, timestamp, upSuffix, downSuffix)
+				continue
+			}
+			files = append(files, name)
+		}
+	}
+	return files, errs, nil
+}
+
+//isScriptFile checks if f is a .sql file, in any case, so that stray files such as
+//.DS_Store, editor swap files or a README in the scripts directory are skipped
+func isScriptFile(f os.FileInfo) bool {
+	if f.IsDir() {
+		return false
+	}
+	if !strings.EqualFold(filepath.Ext(f.Name()), ".sql") {
+		if verbose {
+			log.Printf("Skipping %s, not a .sql file", f.Name())
+		}
+		return false
+	}
+	return true
+}
+
+//parseMigrationFilename gets the timestamp and description from a migration file name
+//of the form <timestamp>_<description>.sql
+func parseMigrationFilename(filename string) (int64, string, error) {
+	matches := migrationFilenameRe.FindStringSubmatch(filename)
+	if matches == nil {
+		return 0, "", fmt.Errorf("Invalid migration file name %s, expected <timestamp>_<description>.sql", filename)
+	}
+	timestamp, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("Invalid timestamp in migration file name %s: %v", filename, err)
+	}
+
+	//the description is the rest of the name with underscores read as spaces. Files
+	//written by older versions have a double underscore.
+	rest := filename[len(matches[0]):]
+	rest = rest[:len(rest)-len(filepath.Ext(rest))]
+	rest = strings.TrimSuffix(strings.TrimSuffix(rest, ".up"), ".down")
+	description := strings.Join(strings.Fields(strings.Replace(rest, "_", " ", -1)), " ")
+	if description == "" {
+		return 0, "", fmt.Errorf("Invalid migration file name %s, the description after the timestamp is empty", filename)
+	}
+	return timestamp, description, nil
+}
+
+//parseMigration builds a migration from its file name and contents
+func parseMigration(filename string, migrationStr string) (*Migration, error) {
+	lines := strings.Split(migrationStr, "\n")
+	var doScript, rawDoScript string
+	var undoScript, rawUndoScript string
+	var schema string
+	var environments []string
+	idempotent := false
+	noTransaction := false
+	metadata := make(map[string]string)
+	//metadata is only read from the comments and blank lines before the first statement
+	header := true
+	doing := true
+	//markers only count on their own line, outside of function bodies and comments
+	var state sqlState
+	for _, line := range lines {
+		marker := false
+		if !state.quoted() {
+			if doMarkerRe.MatchString(line) {
+				doing = true
+				marker = true
+			}
+			if undoMarkerRe.MatchString(line) {
+				doing = false
+				marker = true
+			}
+			if matches := schemaRe.FindStringSubmatch(line); matches != nil {
+				schema = matches[1]
+				if !identifierRe.MatchString(schema) {
+					return nil, fmt.Errorf("%s: invalid schema name %q", filename, schema)
+				}
+			}
+			if matches := environmentsRe.FindStringSubmatch(line); matches != nil {
+				for _, env := range strings.Split(matches[1], ",") {
+					if env = strings.TrimSpace(env); env != "" {
+						environments = append(environments, env)
+					}
+				}
+			}
+			if idempotentRe.MatchString(line) {
+				idempotent = true
+			}
+			if noTransactionRe.MatchString(line) {
+				noTransaction = true
+			}
+			if header {
+				trimmed := strings.TrimSpace(line)
+				if matches := metadataRe.FindStringSubmatch(line); matches != nil && !directives[strings.ToLower(matches[1])] {
+					metadata[strings.ToLower(matches[1])] = matches[2]
+				} else if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+					header = false
+				}
+			}
+		}
+		state.scanLine(line)
+		//marker lines are left out of the scripts that run
+		if doing {
+			rawDoScript = rawDoScript + line + "\n"
+			if !marker {
+				doScript = doScript + line + "\n"
+			}
+		} else {
+			rawUndoScript = rawUndoScript + line + "\n"
+			if !marker {
+				undoScript = undoScript + line + "\n"
+			}
+		}
+	}
+
+	timestamp, description, err := parseMigrationFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Migration{
+		Filename:      filename,
+		Description:   description,
+		Timestamp:     timestamp,
+		DoScript:      doScript,
+		UndoScript:    undoScript,
+		Schema:        schema,
+		Environments:  environments,
+		Idempotent:    idempotent,
+		NoTransaction: noTransaction,
+		Metadata:      metadata,
+		rawDoScript:   rawDoScript,
+		rawUndoScript: rawUndoScript,
+	}
+
+	return &m, nil
+}
+
+//ReadFunction reads a function from file
+func ReadFunction(filename string) *Function {
+	functionScript, err := readScript(FunctionsDir() + filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	//get the timestamp part
+	re := regexp.MustCompile("[0-9]+")
+	matches := re.FindAllString(filename, 1)
+
+	var timestamp int64
+	if len(matches) > 0 {
+		timestamp, err = strconv.ParseInt(matches[0], 10, 64)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		log.Fatalln("Invalid function file name")
+	}
+
+	reDescription := regexp.MustCompile("[a-zA-Z]+")
+
+	descMatches := reDescription.FindAllString(filename, 10)
+
+	//remove the last bit i.e sql in file name
+	descMatches = descMatches[:len(descMatches)-1]
+
+	description := strings.Join(descMatches, " ")
+
+	var depends []int64
+	for _, line := range strings.Split(functionScript, "\n") {
+		matches := dependsRe.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		for _, d := range strings.Split(matches[1], ",") {
+			if d = strings.TrimSpace(d); d == "" {
+				continue
+			}
+			dependency, err := strconv.ParseInt(d, 10, 64)
+			if err != nil {
+				log.Fatalf("%s: invalid @DEPENDS timestamp %q", filename, d)
+			}
+			depends = append(depends, dependency)
+		}
+	}
+
+	f := Function{
+		Description:    description,
+		Timestamp:      timestamp,
+		FunctionScript: functionScript,
+		Depends:        depends,
+	}
+
+	return &f
+}
+
+func ReadFunctionsFromFile() Functions {
+	if err := checkScriptsDir(FunctionsDir()); err != nil {
+		log.Fatalln(err)
+	}
+	fis, err := ioutil.ReadDir(FunctionsDir())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var ms Functions
+	for _, f := range fis {
+		if !isScriptFile(f) {
+			continue
+		}
+		mig := ReadFunction(f.Name())
+		ms = append(ms, *mig)
+	}
+	sort.Sort(ms)
+	return ms
+}
+
+//ReadMigrationIndex lists the migrations with their applied status from the file names
+//alone. Scripts and headers are read with LoadScripts once a migration is going to run.
+func ReadMigrationIndex() Migrations {
+	ms, err := readMigrationIndex(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return ms
+}
+
+//readMigrationIndex is ReadMigrationIndex returning errors. A file with an invalid name
+//does not stop the scan, the migrations are returned along with FileErrors listing every
+//such file.
+func readMigrationIndex(ctx context.Context) (Migrations, error) {
+	files, errs, err := migrationFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedTimestamps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ms Migrations
+	for _, name := range files {
+		timestamp, description, err := parseMigrationFilename(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ms = append(ms, Migration{
+			Filename:    name,
+			Description: description,
+			Timestamp:   timestamp,
+			IsApplied:   applied[timestamp],
+		})
+	}
+	sort.Sort(ms)
+	if len(errs) > 0 {
+		return ms, errs
+	}
+	return ms, nil
+}
+
+//LoadScripts reads the migration file, filling in the scripts and headers of a
+//migration listed by ReadMigrationIndex
+func (m *Migration) LoadScripts() error {
+	loaded, err := loadMigration(m.Filename)
+	if err != nil {
+		return err
+	}
+	loaded.IsApplied = m.IsApplied
+	*m = *loaded
+	return nil
+}
+
+//EmptyUndo reports whether the @UNDO script holds no statements, only whitespace and
+//comments, so undoing the migration would only remove its changelog row
+func (m *Migration) EmptyUndo() bool {
+	return isEmptyScript(m.UndoScript)
+}
+
+//ReadMigrationsFromFile reads all migrations from files
+func ReadMigrationsFromFile() Migrations {
+	ms, err := readMigrationsFromFile(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return ms
+}
+
+//readMigrationsFromFile is ReadMigrationsFromFile returning errors. A file that cannot be
+//read or parsed does not stop the scan, the migrations that could be read are returned
+//along with FileErrors listing the problem with every other file.
+func readMigrationsFromFile(ctx context.Context) (Migrations, error) {
+	files, errs, err := migrationFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedTimestamps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ms Migrations
+	for _, name := range files {
+		mig, err := loadMigration(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		mig.IsApplied = applied[mig.Timestamp]
+		ms = append(ms, *mig)
+	}
+	sort.Sort(ms)
+	if len(errs) > 0 {
+		return ms, errs
+	}
+	return ms, nil
+}
+
+//InitMigration creates migration directory, config.js and initial migration. withExample
+//also writes an example migration and function showing the file formats.
+func InitMigration(migrationPath string, scriptsDir string, withExample bool) {
+	migrationPath, err := filepath.Abs(migrationPath)
+	if err != nil {
+		log.Fatalln("Unable to get absolute path: ", err)
+	}
+	fmt.Println("Initializing migrations at: ", migrationPath)
 	//confirm path exists
 	stats, err := os.Stat(migrationPath)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	//confirm path is a directory
-	if !stats.IsDir() {
-		log.Fatalln("The migration path provided is not a directory")
+	//confirm path is a directory
+	if !stats.IsDir() {
+		log.Fatalln("The migration path provided is not a directory")
+	}
+	//confirm the directory is empty
+	file, err := os.Open(migrationPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	_, err = file.Readdir(1)
+	if err != io.EOF {
+		log.Fatalln("migration directory is not empty ")
+	}
+	//create pgmigrate.json
+	c := Config{
+		DbHost:              defaultDbHost,
+		DbPort:              defaultDbPort,
+		MigrationTableName:  defaultMigrationTableName,
+		ScriptsDir:          scriptsDir,
+		TimestampColumnType: defaultTimestampColumnType,
+		SslMode:             defaultSslMode,
+		FunctionsTableName:  defaultFunctionsTableName,
+	}
+	cbytes, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = ioutil.WriteFile(migrationPath+"/pgmigrate.json", cbytes, defaultFilePermission)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	//create scripts folder with the functions folder in it
+	dir := scriptsDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(migrationPath, dir)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "functions"), defaultDirPermission)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if withExample {
+		if err := writeExamples(dir); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+var exampleMigration = `-- create example table --
+-- An example migration, delete it once you have written your own. 'pgmigrate up' runs
+-- the script after the DO marker and 'pgmigrate down' the one after the UNDO marker,
+-- which should reverse it. Both run in a transaction along with the changelog update.
+-- @DO sql script --
+CREATE TABLE example (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- @UNDO sql script --
+DROP TABLE example;
+`
+
+var exampleFunction = `-- example full name --
+-- An example function, delete it once you have written your own. 'pgmigrate
+-- run-functions' runs every file in this folder, oldest first, and runs a file again
+-- whenever it changes, so functions are written with create or replace.
+create or replace function example_full_name(first_name text, last_name text) returns text
+language plpgsql
+as $$
+    begin
+        return first_name || ' ' || last_name;
+    end;
+$$;
+`
+
+//writeExamples writes exampleMigration and exampleFunction to the scripts directory dir
+func writeExamples(dir string) error {
+	now := time.Now()
+	functionsDir := filepath.Join(dir, "functions")
+	examples := []struct {
+		path    string
+		content string
+	}{
+		{filepath.Join(dir, fmt.Sprintf("%d_create_example_table.sql", newTimestamp(dir, now))), exampleMigration},
+		{filepath.Join(functionsDir, fmt.Sprintf("%d_example_full_name.sql", newTimestamp(functionsDir, now))), exampleFunction},
+	}
+	for _, example := range examples {
+		if err := ioutil.WriteFile(example.path, []byte(example.content), defaultFilePermission); err != nil {
+			return err
+		}
+		printCreated(example.path)
+	}
+	return nil
+}
+
+//NewMigration creates a new migration
+func NewMigration(description string) {
+	newMigration(description, "", "")
+}
+
+//timestampFormat is the layout of the timestamp of new migrations, YYYYMMDDHHMMSS in UTC.
+//It is numeric and later than any unix timestamp used by older versions, so migrations
+//keep sorting in the order they were created.
+const timestampFormat = "20060102150405"
+
+//newTimestamp returns the timestamp for a migration or function created at t in dir,
+//moved a second later for as long as a file in dir already has it
+func newTimestamp(dir string, t time.Time) int64 {
+	taken := make(map[int64]bool)
+	//the directory may not exist yet
+	fis, _ := ioutil.ReadDir(dir)
+	for _, f := range fis {
+		if timestamp, _, err := parseMigrationFilename(f.Name()); err == nil {
+			taken[timestamp] = true
+		}
+	}
+	t = t.UTC()
+	for {
+		timestamp, err := strconv.ParseInt(t.Format(timestampFormat), 10, 64)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !taken[timestamp] {
+			return timestamp
+		}
+		t = t.Add(time.Second)
+	}
+}
+
+//newMigration writes a new migration file with the given scripts
+func newMigration(description string, doScript string, undoScript string) {
+	m := Migration{Description: description, Timestamp: newTimestamp(MigrationsDir(), time.Now()), DoScript: doScript, UndoScript: undoScript}
+
+	//write migration to file
+	path, err := m.WriteToFile()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printCreated(path)
+}
+
+//NewFunction creates a new function
+func NewFunction(description string) {
+	m := Function{Description: description, Timestamp: newTimestamp(FunctionsDir(), time.Now())}
+
+	//write migration to file
+	path, err := m.WriteToFile()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printCreated(path)
+}
+
+//printCreated reports a new file, relative to the current directory where possible
+func printCreated(path string) {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil {
+			path = rel
+		}
+	}
+	fmt.Println("Created", path)
+}
+
+//CreateChangeLogTable creates changelog table
+func CreateChangeLogTable() {
+	if err := createChangeLogTable(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//createChangeLogTable is CreateChangeLogTable returning an error
+func createChangeLogTable(ctx context.Context) error {
+	//commands allowed under --read-only or --dry-run only read the changelog, which may not
+	//exist yet
+	if readOnly || dryRun {
+		return nil
+	}
+	c := GetConfig()
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id SERIAL PRIMARY KEY, timestamp %s, description VARCHAR(500), applied_at TIMESTAMPTZ DEFAULT now(), checksum VARCHAR(64), author VARCHAR(200));", c.quotedChangelogTable(), c.TimestampColumnType)
+	//changelog tables created by older versions lack applied_at, checksum and author
+	alterQuery := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS applied_at TIMESTAMPTZ DEFAULT now(), ADD COLUMN IF NOT EXISTS checksum VARCHAR(64), ADD COLUMN IF NOT EXISTS author VARCHAR(200);", c.quotedChangelogTable())
+	if sqlOnly {
+		printSQL(query)
+		printSQL(alterQuery)
+		return nil
+	}
+	err := execDDLWithRetry(ctx, query)
+	if err == nil {
+		err = execDDLWithRetry(ctx, alterQuery)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to create the changelog table %s: %v", c.ChangelogTable(), err)
+	}
+	return nil
+}
+
+//isConcurrentDDL checks if err is one of the errors postgres gives when two sessions create
+//the same table at the same time, even with IF NOT EXISTS
+func isConcurrentDDL(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code.Name() {
+	case "duplicate_table", "duplicate_object", "unique_violation":
+		return true
+	case "internal_error":
+		return strings.Contains(pqErr.Message, "tuple concurrently updated")
+	}
+	return false
+}
+
+//execDDLWithRetry executes a statement creating or altering a changelog table, retrying
+//it when it races with the same statement from a concurrent run
+func execDDLWithRetry(ctx context.Context, query string) error {
+	retries := defaultCreateTableRetries
+	if c := GetConfig(); c.CreateTableRetries != nil {
+		retries = *c.CreateTableRetries
+	}
+	changelog, err := getChangelogDbContext(ctx)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		_, err = changelog.ExecContext(ctx, query)
+		if err == nil || !isConcurrentDDL(err) || attempt >= retries {
+			return err
+		}
+		log.Printf("Retrying after concurrent table creation: %v", err)
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+}
+
+//UpOptions controls which pending migrations Up applies
+type UpOptions struct {
+	//N limits the number of migrations applied, 0 applies all of them
+	N int64
+	//ContinueFrom skips pending migrations older than this timestamp
+	ContinueFrom int64
+	//Force skips the check that the changelog matches the migration files
+	Force bool
+	//Target stops at the migration with this timestamp, 0 means no target
+	Target int64
+	//SummaryJSON is the file the run summary is written to, - for stdout and empty for none
+	SummaryJSON string
+	//AllowDirty applies pending migrations even if applied ones were edited
+	AllowDirty bool
+	//UntilDuration stops before a migration that could end after this much time has passed
+	//since the run started, 0 means no limit
+	UntilDuration time.Duration
+	//ReportSkipped prints the pending migrations that will be skipped or applied out of order
+	//before applying anything
+	ReportSkipped bool
+}
+
+//ReadTargetVersion reads the timestamp of the migration the database should be at from a file
+func ReadTargetVersion(path string) (int64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	version := strings.TrimSpace(string(content))
+	target, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid target version %q", path, version)
+	}
+	return target, nil
+}
+
+//ReportSkipped prints the pending migrations up will skip because of --continue-from,
+//--target-version-file or @ENVIRONMENTS, and those older than the latest applied migration,
+//which up applies out of order
+func ReportSkipped(migrations Migrations, opts UpOptions, env string) {
+	latest := latestApplied(migrations)
+
+	reported := 0
+	for _, m := range migrations {
+		if m.IsApplied {
+			continue
+		}
+		var reason string
+		switch {
+		case m.Timestamp < opts.ContinueFrom:
+			reason = fmt.Sprintf("skipped, older than --continue-from %d", opts.ContinueFrom)
+		case opts.Target != 0 && m.Timestamp > opts.Target:
+			reason = fmt.Sprintf("skipped, after target version %d", opts.Target)
+		default:
+			if err := m.LoadScripts(); err != nil {
+				log.Fatalln(err)
+			}
+			if !m.AllowedIn(env) {
+				reason = fmt.Sprintf("skipped, it only runs in %s", strings.Join(m.Environments, ", "))
+			} else if m.Timestamp < latest && GetConfig().OutOfOrder == "skip" {
+				reason = fmt.Sprintf("skipped, older than the latest applied migration %d", latest)
+			} else if m.Timestamp < latest {
+				reason = fmt.Sprintf("out of order, older than the latest applied migration %d", latest)
+			}
+		}
+		if reason != "" {
+			fmt.Printf("%d	%s		%s\n", m.Timestamp, m.Description, reason)
+			reported++
+		}
+	}
+	if reported == 0 {
+		fmt.Println("No pending migrations will be skipped or applied out of order.")
+	}
+}
+
+//latestApplied returns the timestamp of the newest applied migration, 0 if none is applied
+func latestApplied(migrations Migrations) int64 {
+	var latest int64
+	for _, m := range migrations {
+		if m.IsApplied && m.Timestamp > latest {
+			latest = m.Timestamp
+		}
+	}
+	return latest
+}
+
+//checkOutOfOrder returns an error wrapping ErrOutOfOrder for the first pending migration
+//older than latest that up would apply
+func checkOutOfOrder(migrations Migrations, latest int64, continueFrom int64, env string) error {
+	for i := range migrations {
+		m := &migrations[i]
+		if m.IsApplied || m.Timestamp >= latest || m.Timestamp < continueFrom {
+			continue
+		}
+		//a migration for another environment is never applied here, so it is not out of order
+		if err := m.LoadScripts(); err != nil {
+			return err
+		}
+		if m.AllowedIn(env) {
+			return fmt.Errorf("%w: %d %s is older than the latest applied migration %d, set outOfOrder to allow to apply it or to skip to leave it pending", ErrOutOfOrder, m.Timestamp, m.Description, latest)
+		}
+	}
+	return nil
+}
+
+//Up applies the 'up' migration
+func Up(ctx context.Context, opts UpOptions) {
+	summary, err := up(ctx, opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printTimings("Applied", summary.Migrations, time.Duration(summary.DurationMs)*time.Millisecond)
+	if opts.SummaryJSON != "" {
+		writeSummary(opts.SummaryJSON, summary)
+	}
+}
+
+//up is Up returning the run summary and the first error instead of exiting
+func up(ctx context.Context, opts UpOptions) (RunSummary, error) {
+	n := opts.N
+	continueFrom := opts.ContinueFrom
+	summary := RunSummary{Migrations: []MigrationTiming{}}
+
+	//before taking the lock, so a wrong working directory fails without connecting
+	if err := checkScriptsDir(MigrationsDir()); err != nil {
+		return summary, err
+	}
+	release, err := acquireLock(ctx)
+	if err != nil {
+		return summary, err
+	}
+	defer release()
+	if err := createChangeLogTable(ctx); err != nil {
+		return summary, err
+	}
+
+	migrations, err := readMigrationIndex(ctx)
+	if err != nil {
+		return summary, err
+	}
+	if !opts.Force {
+		if err := checkInSync(ctx, migrations); err != nil {
+			return summary, err
+		}
+	}
+	if c := GetConfig(); c.DriftCheck == nil || *c.DriftCheck {
+		if err := checkDrift(ctx, migrations, opts.AllowDirty); err != nil {
+			return summary, err
+		}
+	}
+	if opts.Target != 0 {
+		for _, m := range migrations {
+			if m.IsApplied && m.Timestamp > opts.Target {
+				return summary, fmt.Errorf("%d %s is applied but is after target version %d, roll back to it with 'pgmigrate goto %d' instead", m.Timestamp, m.Description, opts.Target, opts.Target)
+			}
+		}
+	}
+	env := ActiveEnvironment()
+	if opts.ReportSkipped {
+		ReportSkipped(migrations, opts, env)
+	}
+	latest := latestApplied(migrations)
+	outOfOrder := GetConfig().OutOfOrder
+	if outOfOrder == "strict" {
+		if err := checkOutOfOrder(migrations, latest, continueFrom, env); err != nil {
+			return summary, err
+		}
+	}
+
+	start := time.Now()
+	var slowest time.Duration
+	timedOut := false
+	count := 0 //number of migrations applied, up n stops once it reaches n
+	for i := range migrations {
+		m := &migrations[i]
+		if m.Timestamp < continueFrom {
+			if !m.IsApplied {
+				log.Printf("Warning: %d %s is before %d but has not been applied, skipping", m.Timestamp, m.Description, continueFrom)
+			}
+			continue
+		}
+		if m.IsApplied {
+			continue
+		}
+		if outOfOrder == "skip" && m.Timestamp < latest {
+			log.Printf("Skipping %s, it is older than the latest applied migration %d", m.Description, latest)
+			continue
+		}
+		if opts.Target != 0 && m.Timestamp > opts.Target {
+			break
+		}
+		if n > 0 && int64(count) >= n {
+			break
+		}
+		//the next migration is assumed to take as long as the slowest one so far
+		if opts.UntilDuration > 0 && time.Since(start)+slowest > opts.UntilDuration {
+			timedOut = true
+			break
+		}
+		//only the scripts of migrations that are going to run are read
+		if err := m.LoadScripts(); err != nil {
+			return summary, err
+		}
+		if !m.AllowedIn(env) {
+			log.Printf("Skipping %s, it only runs in %s", m.Description, strings.Join(m.Environments, ", "))
+			continue
+		}
+		elapsed, err := tryMigration(ctx, "up", "Applying", m, m.Do)
+		if err != nil {
+			return summary, err
+		}
+		count++
+		m.IsApplied = true
+		if elapsed > slowest {
+			slowest = elapsed
+		}
+		summary.Migrations = append(summary.Migrations, MigrationTiming{Timestamp: m.Timestamp, Description: m.Description, DurationMs: elapsed.Milliseconds()})
+	}
+
+	if timedOut {
+		remaining := 0
+		for _, m := range migrations {
+			skipped := outOfOrder == "skip" && m.Timestamp < latest
+			if !m.IsApplied && !skipped && m.Timestamp >= continueFrom && (opts.Target == 0 || m.Timestamp <= opts.Target) {
+				remaining++
+			}
+		}
+		log.Printf("Stopping to stay within %s, applied %d migration(s) in %s, %d remaining", opts.UntilDuration, len(summary.Migrations), time.Since(start).Round(time.Second), remaining)
 	}
-	//confirm the directory is empty
-	file, err := os.Open(migrationPath)
+
+	summary.Applied = len(summary.Migrations)
+	summary.DurationMs = time.Since(start).Milliseconds()
+	for _, m := range migrations {
+		if m.IsApplied && m.Timestamp > summary.Version {
+			summary.Version = m.Timestamp
+		}
+	}
+	return summary, nil
+}
+
+//DownOptions controls which applied migrations Down undoes
+type DownOptions struct {
+	//N is the number of migrations to undo
+	N int64
+	//All undoes every applied migration, ignoring N
+	All bool
+	//Force allows rolling back past the protected baseline and migrations with an empty
+	//@UNDO script, and skips the check that the changelog matches the migration files
+	Force bool
+	//Preview lists what would be undone without changing the database
+	Preview bool
+}
+
+//Down applies the 'down' migration
+func Down(ctx context.Context, opts DownOptions) {
+	start := time.Now()
+	timings, err := down(ctx, opts)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	_, err = file.Readdir(1)
-	if err != io.EOF {
-		log.Fatalln("migration directory is not empty ")
+	printTimings("Undid", timings, time.Since(start))
+}
+
+//down is Down returning how long each migration took and the first error instead of exiting
+func down(ctx context.Context, opts DownOptions) ([]MigrationTiming, error) {
+	n := opts.N
+	var timings []MigrationTiming
+
+	if err := checkScriptsDir(MigrationsDir()); err != nil {
+		return nil, err
 	}
-	//create pgmigrate.json
-	var c Config
-	cbytes, err := json.MarshalIndent(c, "", "\t")
-	if err != nil {
-		log.Fatalln(err)
+	if !opts.Preview {
+		release, err := acquireLock(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		if err := createChangeLogTable(ctx); err != nil {
+			return nil, err
+		}
 	}
-	err = ioutil.WriteFile(migrationPath+"/pgmigrate.json", cbytes, defaultFilePermission)
+
+	migrations, err := readMigrationIndex(ctx)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	if !opts.Force && !opts.Preview {
+		if err := checkInSync(ctx, migrations); err != nil {
+			return nil, err
+		}
+	}
+	//reverse the order of migrations when going down
+	sort.Sort(sort.Reverse(migrations))
+	var undo Migrations
+	for _, m := range migrations {
+		if !opts.All && int64(len(undo)) >= n {
+			break
+		}
+		//with --sql-only every migration is treated as applied when going down
+		if m.IsApplied || sqlOnly {
+			undo = append(undo, m)
+		}
 	}
 
-	//create scripts folder
-	err = os.Mkdir(migrationPath+"/scripts", defaultDirPermission)
-	if err != nil {
-		log.Fatalln(err)
+	if opts.Preview {
+		PreviewRollback(undo)
+		return nil, nil
 	}
+	if !opts.Force {
+		if err := checkProtectedBaseline(undo); err != nil {
+			return nil, err
+		}
+	}
+	for i := range undo {
+		if err := undo[i].LoadScripts(); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkUndoScripts(undo, opts.Force); err != nil {
+		return nil, err
+	}
+	for _, m := range undo {
+		elapsed, err := tryMigration(ctx, "down", "Undoing", &m, m.Undo)
+		if err != nil {
+			return timings, err
+		}
+		timings = append(timings, MigrationTiming{Timestamp: m.Timestamp, Description: m.Description, DurationMs: elapsed.Milliseconds()})
+	}
+	return timings, nil
+}
 
-	//make functions folder
-	err = os.Mkdir(migrationPath+"/scripts/functions", defaultDirPermission)
-	if err != nil {
+//Redo undoes the most recently applied migration and applies it again, for iterating on
+//a migration while writing it. force allows redoing a migration at or before the
+//protected baseline or with an empty @UNDO script.
+func Redo(ctx context.Context, force bool) {
+	defer mustLock(ctx)()
+	CreateChangeLogTable()
+
+	migrations := ReadMigrationIndex()
+	if !force {
+		CheckInSync(migrations)
+	}
+	var last *Migration
+	for i := range migrations {
+		//with --sql-only the latest migration is treated as applied, as in down
+		if migrations[i].IsApplied || sqlOnly {
+			last = &migrations[i]
+		}
+	}
+	if last == nil {
+		log.Fatalln("No applied migrations to redo")
+	}
+	if !force {
+		CheckProtectedBaseline(Migrations{*last})
+	}
+	if err := last.LoadScripts(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkUndoScripts(Migrations{*last}, force); err != nil {
 		log.Fatalln(err)
 	}
+	runMigration(ctx, "redo", "Undoing", last, last.Undo)
+	runMigration(ctx, "redo", "Applying", last, last.Do)
 }
 
-//NewMigration creates a new migration
-func NewMigration() {
-	//confirm description is provided
-	if len(os.Args) < 3 {
-		log.Fatalln("Invalid paramenters. Usage: pgmigrate new migration description text")
-	}
+//Goto brings the database to the migration with the target timestamp: applied migrations
+//after it are undone, newest first, then pending migrations up to and including it are
+//applied. force allows undoing migrations at or before the protected baseline or with an
+//empty @UNDO script and skips the maxMissingFiles check.
+func Goto(ctx context.Context, target int64, force bool) {
+	defer mustLock(ctx)()
+	CreateChangeLogTable()
 
-	//create new migration
-	var description string
-	for i, s := range os.Args {
-		if i > 1 {
-			description = description + " " + s
+	migrations := ReadMigrationIndex()
+	if !force {
+		CheckInSync(migrations)
+	}
+	found := false
+	var undo, do Migrations
+	for _, m := range migrations {
+		switch {
+		case m.Timestamp == target:
+			found = true
+			if !m.IsApplied {
+				do = append(do, m)
+			}
+		case m.Timestamp > target && m.IsApplied:
+			undo = append(undo, m)
+		case m.Timestamp < target && !m.IsApplied:
+			do = append(do, m)
 		}
 	}
-	m := Migration{Description: description, Timestamp: time.Now().Unix()}
+	if !found {
+		log.Fatalf("No migration with timestamp %d in %s", target, MigrationsDir())
+	}
+	sort.Sort(sort.Reverse(undo))
+	if !force {
+		CheckProtectedBaseline(undo)
+	}
 
-	//write migration to file
-	err := m.WriteToFile()
-	if err != nil {
+	for i := range undo {
+		if err := undo[i].LoadScripts(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := checkUndoScripts(undo, force); err != nil {
 		log.Fatalln(err)
 	}
+	for i := range undo {
+		m := &undo[i]
+		runMigration(ctx, "goto", "Undoing", m, m.Undo)
+	}
+	env := ActiveEnvironment()
+	for i := range do {
+		m := &do[i]
+		if err := m.LoadScripts(); err != nil {
+			log.Fatalln(err)
+		}
+		if !m.AllowedIn(env) {
+			log.Printf("Skipping %s, it only runs in %s", m.Description, strings.Join(m.Environments, ", "))
+			continue
+		}
+		runMigration(ctx, "goto", "Applying", m, m.Do)
+	}
+	if len(undo) == 0 && len(do) == 0 {
+		log.Printf("Already at %d", target)
+	}
 }
 
-//NewFunction creates a new function
-func NewFunction() {
-	//confirm description is provided
-	if len(os.Args) < 3 {
-		log.Fatalln("Invalid paramenters. Usage: pgmigrate function migration description text")
+//Force records the migration with the given timestamp as applied without running its
+//@DO script, e.g. after it was applied by hand, or with remove deletes its changelog row
+//without running its @UNDO script
+func Force(timestamp int64, remove bool) {
+	defer mustLock(context.Background())()
+	CreateChangeLogTable()
+	c := GetConfig()
+
+	var m *Migration
+	for _, indexed := range ReadMigrationIndex() {
+		if indexed.Timestamp == timestamp {
+			m = &indexed
+			break
+		}
 	}
 
-	//create new migration
-	var description string
-	for i, s := range os.Args {
-		if i > 1 {
-			description = description + " " + s
+	if remove {
+		deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", c.quotedChangelogTable(), c.TimestampColumn())
+		if sqlOnly {
+			printSQL(deleteSQL, timestamp)
+			return
+		}
+		result, err := getChangelogDb().Exec(deleteSQL, timestamp)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			log.Fatalf("%d is not recorded as applied in %s", timestamp, c.ChangelogTable())
+		}
+		log.Printf("Removed %d from %s", timestamp, c.ChangelogTable())
+		return
 	}
-	m := Function{Description: description, Timestamp: time.Now().Unix()}
 
-	//write migration to file
-	err := m.WriteToFile()
-	if err != nil {
+	if m == nil {
+		log.Fatalf("No migration with timestamp %d in %s", timestamp, MigrationsDir())
+	}
+	if m.IsApplied {
+		log.Fatalf("%d %s is already applied", m.Timestamp, m.Description)
+	}
+	if err := m.LoadScripts(); err != nil {
+		log.Fatalln(err)
+	}
+	insertSQL := fmt.Sprintf("INSERT INTO %s (timestamp, description, checksum, author) VALUES ($1, $2, $3, $4)", c.quotedChangelogTable())
+	if sqlOnly {
+		printSQL(insertSQL, m.Timestamp, m.Description, m.Checksum(), nullIfEmpty(m.Author()))
+		return
+	}
+	if _, err := getChangelogDb().Exec(insertSQL, m.Timestamp, m.Description, m.Checksum(), nullIfEmpty(m.Author())); err != nil {
 		log.Fatalln(err)
 	}
+	log.Printf("Recorded %d %s as applied without running it", m.Timestamp, m.Description)
 }
 
-//CreateChangeLogTable creates changelog table
-func CreateChangeLogTable() {
+//PreviewRollback prints the migrations that would be undone, in the order they would be undone
+func PreviewRollback(ms Migrations) {
+	if len(ms) == 0 {
+		fmt.Println("Nothing to undo.")
+		return
+	}
 	c := GetConfig()
-	query := fmt.Sprintf("CREATE TABLE %s (id SERIAL PRIMARY KEY, timestamp NUMERIC, description VARCHAR(500));", c.MigrationTableName)
-	db := getDb()
-	db.Exec(query)
+	fmt.Println("The following migrations would be undone:")
+	for _, m := range ms {
+		note := ""
+		if c.ProtectedBaseline != 0 && m.Timestamp <= c.ProtectedBaseline {
+			note = "(protected baseline, needs --force)"
+		}
+		fmt.Printf("%d	%s		%s \n", m.Timestamp, m.Description, note)
+	}
 }
 
-//Up applies the 'up' migration
-func Up() {
-	CreateChangeLogTable()
+//CheckInSync exits if more applied migrations than the configured limit have no file in
+//the migrations directory, which usually means pgmigrate is running against the wrong database or in the
+//wrong directory
+func CheckInSync(ms Migrations) {
+	if err := checkInSync(context.Background(), ms); err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	n := int64(0)
-	if len(os.Args) > 2 {
-		nstr := os.Args[2]
-		var err error
-		n, err = strconv.ParseInt(nstr, 10, 32)
-		if err != nil {
-			n = int64(0)
+//checkInSync is CheckInSync returning an error
+func checkInSync(ctx context.Context, ms Migrations) error {
+	c := GetConfig()
+	limit := defaultMaxMissingFiles
+	if c.MaxMissingFiles != nil {
+		limit = *c.MaxMissingFiles
+	}
+	files := make(map[int64]bool)
+	for _, m := range ms {
+		files[m.Timestamp] = true
+	}
+	applied, err := appliedTimestamps(ctx)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for timestamp := range applied {
+		if !files[timestamp] {
+			missing++
 		}
 	}
-	migrations := ReadMigrationsFromFile()
+	if missing > limit {
+		return fmt.Errorf("refusing to run, %d applied migrations in %s have no file in %s (%d files, maxMissingFiles %d). Check the directory and database, or use --force to override", missing, c.ChangelogTable(), MigrationsDir(), len(ms), limit)
+	}
+	return nil
+}
 
-	count := 0 //track number of migrations applied
-	for _, m := range migrations {
-		if !m.IsApplied {
-			if n == int64(0) {
-				log.Printf("Applying %s ...", m.Description)
-				m.Do()
-			} else {
-				if int64(count) <= n {
-					log.Printf("Applying %s ...", m.Description)
-					m.Do()
-					count++
-				}
-			}
+//CheckProtectedBaseline exits if any of the migrations is at or before the configured protected baseline
+func CheckProtectedBaseline(ms Migrations) {
+	if err := checkProtectedBaseline(ms); err != nil {
+		log.Fatalln(err)
+	}
+}
 
+//checkProtectedBaseline is CheckProtectedBaseline returning an error
+func checkProtectedBaseline(ms Migrations) error {
+	c := GetConfig()
+	if c.ProtectedBaseline == 0 {
+		return nil
+	}
+	for _, m := range ms {
+		if m.Timestamp <= c.ProtectedBaseline {
+			return fmt.Errorf("refusing to roll back past protected baseline %d (%d %s), use --force to override", c.ProtectedBaseline, m.Timestamp, m.Description)
 		}
 	}
+	return nil
+}
 
+//checkUndoScripts fails if any of the migrations, whose scripts must be loaded, has an
+//empty @UNDO script, since undoing it would remove its changelog row and leave its changes
+//in place. With force it logs a warning for each one instead.
+func checkUndoScripts(ms Migrations, force bool) error {
+	for _, m := range ms {
+		if !m.EmptyUndo() {
+			continue
+		}
+		if !force {
+			return fmt.Errorf("refusing to undo %s, it has no rollback SQL under @UNDO so only its changelog row would be removed. Use --force to override", m.Filename)
+		}
+		log.Printf("Warning: %s has no rollback SQL under @UNDO, only its changelog row will be removed", m.Filename)
+	}
+	return nil
 }
 
-//Down applies the 'down' migration
-func Down() {
+//RunFunctions runs the function scripts, skipping functions whose script has not changed
+//since they were last run unless force is set
+func RunFunctions(ctx context.Context, force bool) {
+	if err := checkScriptsDir(FunctionsDir()); err != nil {
+		log.Fatalln(err)
+	}
+	defer mustLock(ctx)()
+	functions := ReadFunctionsFromFile()
+	//oldest first, so later functions can use the types and helpers defined by earlier ones
+	sort.Sort(functions)
+	functions, err := orderFunctions(functions)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	CreateFunctionsChangeLogTable()
 
-	CreateChangeLogTable()
+	var checksums map[int64]string
+	if !force {
+		checksums = FunctionChecksums()
+	}
+	for _, f := range functions {
+		if !force && checksums[f.Timestamp] == f.Checksum() {
+			log.Printf("Skipping unchanged function %s ...", f.Description)
+			continue
+		}
+		if err := f.RunFunction(ctx); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
 
-	n := int64(0)
-	if len(os.Args) > 2 {
-		nstr := os.Args[2]
-		var err error
-		n, err = strconv.ParseInt(nstr, 10, 64)
-		if err != nil {
-			n = int64(0)
+//CreateFunctionsChangeLogTable creates the table recording the checksum of each function run
+func CreateFunctionsChangeLogTable() {
+	c := GetConfig()
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (timestamp BIGINT PRIMARY KEY, description VARCHAR(500), checksum VARCHAR(64), applied_at TIMESTAMPTZ DEFAULT now());", c.quotedFunctionsChangelogTable())
+	if sqlOnly {
+		printSQL(query)
+		return
+	}
+	err := execDDLWithRetry(context.Background(), query)
+	if err != nil {
+		log.Fatalf("Unable to create the functions changelog table %s: %v", c.FunctionsChangelogTable(), err)
+	}
+}
+
+//orderFunctions orders functions so each one comes after the functions it depends on,
+//otherwise keeping the order they were given in
+func orderFunctions(functions Functions) (Functions, error) {
+	byTimestamp := make(map[int64]bool)
+	for _, f := range functions {
+		byTimestamp[f.Timestamp] = true
+	}
+	for _, f := range functions {
+		for _, d := range f.Depends {
+			if !byTimestamp[d] {
+				return nil, fmt.Errorf("function %d %s depends on %d, which does not exist", f.Timestamp, f.Description, d)
+			}
 		}
 	}
-	migrations := ReadMigrationsFromFile()
-	//reverse the order of migrations when going down
-	sort.Sort(sort.Reverse(migrations))
-	count := 0
-	for _, m := range migrations {
-		if int64(count) <= n {
-			if m.IsApplied {
-				log.Printf("Undoing %s ...", m.Description)
-				m.Undo()
-				count++
+
+	done := make(map[int64]bool)
+	var ordered Functions
+	for len(ordered) < len(functions) {
+		progressed := false
+		for _, f := range functions {
+			if done[f.Timestamp] || !dependenciesDone(f, done) {
+				continue
+			}
+			ordered = append(ordered, f)
+			done[f.Timestamp] = true
+			progressed = true
+			//start over so earlier functions that are now ready keep their place
+			break
+		}
+		if !progressed {
+			var cycle []string
+			for _, f := range functions {
+				if !done[f.Timestamp] {
+					cycle = append(cycle, fmt.Sprintf("%d %s", f.Timestamp, f.Description))
+				}
 			}
+			return nil, fmt.Errorf("dependency cycle between functions: %s", strings.Join(cycle, ", "))
 		}
 	}
+	return ordered, nil
 }
 
-//Down applies the 'down' migration
-func RunFunctions() {
+//dependenciesDone checks if every function f depends on is done
+func dependenciesDone(f Function, done map[int64]bool) bool {
+	for _, d := range f.Depends {
+		if !done[d] {
+			return false
+		}
+	}
+	return true
+}
 
-	functions := ReadFunctionsFromFile()
-	//reverse the order of migrations when going down
-	sort.Sort(sort.Reverse(functions))
-	for _, f := range functions {
-		f.RunFunction()
+//FunctionChecksums returns the checksum each function had when it was last run, keyed by timestamp
+func FunctionChecksums() map[int64]string {
+	checksums := make(map[int64]string)
+	if sqlOnly {
+		return checksums
+	}
+	c := GetConfig()
+	rows, err := getChangelogDb().Query(fmt.Sprintf("SELECT timestamp, checksum FROM %s", c.quotedFunctionsChangelogTable()))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp int64
+		var checksum string
+		if err = rows.Scan(&timestamp, &checksum); err != nil {
+			log.Fatalln(err)
+		}
+		checksums[timestamp] = checksum
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalln(err)
 	}
+	return checksums
 }
 
 //Status shows the status of all migrations
-func Status() {
-	CreateChangeLogTable()
-	migrations := ReadMigrationsFromFile()
+func Status(opts StatusOptions) {
+	//only reads the changelog, a missing changelog table means nothing is applied
+	all, err := readMigrationsFromFile(context.Background())
+	var fileErrs FileErrors
+	if err != nil && !errors.As(err, &fileErrs) {
+		log.Fatalln(err)
+	}
+	//the migrations that could be read are listed before the files that could not
+	defer func() {
+		for _, err := range fileErrs {
+			log.Println(err)
+		}
+		if len(fileErrs) > 0 {
+			os.Exit(1)
+		}
+	}()
+
+	var migrations Migrations
+	for _, m := range all {
+		if (opts.Pending && m.IsApplied) || (opts.Applied && !m.IsApplied) {
+			continue
+		}
+		migrations = append(migrations, m)
+	}
+	appliedAt := appliedTimes()
+	if opts.JSON {
+		printStatusJSON(migrations, appliedAt)
+		return
+	}
 	for _, m := range migrations {
 		var status string
 		if m.IsApplied {
 			status = "Applied"
+			if t, ok := appliedAt[m.Timestamp]; ok {
+				status += " " + t.Format(time.RFC3339)
+			}
 		} else {
 			status = "Pending"
 		}
+		if author := m.Author(); author != "" {
+			status += "	" + author
+		}
 		fmt.Printf("%d	%s		%s \n", m.Timestamp, m.Description, status)
 	}
 }
+
+//appliedTimes reads when each applied migration was applied. It is empty if the changelog
+//table does not exist or was created before applied_at was recorded and not altered since.
+func appliedTimes() map[int64]time.Time {
+	times := make(map[int64]time.Time)
+	if sqlOnly {
+		return times
+	}
+	c := GetConfig()
+	query := fmt.Sprintf("SELECT %s, applied_at FROM %s WHERE applied_at IS NOT NULL", c.TimestampColumn(), c.quotedChangelogTable())
+	rows, err := getChangelogDb().Query(query)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code.Name() == "undefined_table" || pqErr.Code.Name() == "undefined_column") {
+			return times
+		}
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp int64
+		var appliedAt time.Time
+		if err = rows.Scan(&timestamp, &appliedAt); err != nil {
+			log.Fatalln(err)
+		}
+		times[timestamp] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	return times
+}
+
+//StatusOptions are the options of Status
+type StatusOptions struct {
+	//JSON prints the migrations as a JSON array instead of a table
+	JSON bool
+	//Pending lists only the migrations that are not applied
+	Pending bool
+	//Applied lists only the migrations that are applied
+	Applied bool
+}
+
+//MigrationStatus is a migration as listed by status --json
+type MigrationStatus struct {
+	Timestamp   int64  `json:"timestamp"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+	//AppliedAt is when the migration was applied, left out if it is pending or the time
+	//was not recorded
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+	//Author is the -- @AUTHOR of the migration file
+	Author string `json:"author,omitempty"`
+}
+
+//printStatusJSON prints the migrations, whether they are applied and when as a JSON array
+func printStatusJSON(ms Migrations, appliedAt map[int64]time.Time) {
+	statuses := []MigrationStatus{}
+	for _, m := range ms {
+		status := MigrationStatus{Timestamp: m.Timestamp, Description: m.Description, Applied: m.IsApplied, Author: m.Author()}
+		if t, ok := appliedAt[m.Timestamp]; ok && m.IsApplied {
+			status.AppliedAt = &t
+		}
+		statuses = append(statuses, status)
+	}
+	statusJSON, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(string(statusJSON))
+}
+
+//History shows the migrations recorded in the changelog in the order they were applied,
+//most recently applied first unless oldestFirst is set. The order comes from the serial
+//id, since applied_at is the same for every row of a table it was added to later.
+func History(oldestFirst bool) {
+	c := GetConfig()
+	db := getChangelogDb()
+	order := "DESC"
+	if oldestFirst {
+		order = "ASC"
+	}
+	query := fmt.Sprintf("SELECT timestamp, description, applied_at, author FROM %s ORDER BY id %s", c.quotedChangelogTable(), order)
+	rows, err := db.Query(query)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "undefined_column" {
+		//the changelog was created before authors were recorded and not altered since
+		query = fmt.Sprintf("SELECT timestamp, description, applied_at, NULL FROM %s ORDER BY id %s", c.quotedChangelogTable(), order)
+		rows, err = db.Query(query)
+	}
+	if err != nil {
+		if isUndefinedTable(err) {
+			fmt.Println("No migrations have been applied.")
+			return
+		}
+		log.Fatalln(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var timestamp int64
+		var description string
+		var appliedAt sql.NullTime
+		var author sql.NullString
+		err = rows.Scan(&timestamp, &description, &appliedAt, &author)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		applied := "unknown"
+		if appliedAt.Valid {
+			applied = appliedAt.Time.Format(time.RFC3339)
+		}
+		if author.Valid && author.String != "" {
+			applied += "	" + author.String
+		}
+		fmt.Printf("%d	%s		%s \n", timestamp, description, applied)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//Version prints the timestamp and description of the latest applied migration
+func Version() {
+	c := GetConfig()
+	query := fmt.Sprintf("SELECT timestamp, description FROM %s ORDER BY %s DESC LIMIT 1", c.quotedChangelogTable(), c.TimestampColumn())
+	var timestamp int64
+	var description string
+	err := getChangelogDb().QueryRow(query).Scan(&timestamp, &description)
+	//the changelog table is not created until something is applied
+	if err == sql.ErrNoRows || isUndefinedTable(err) {
+		fmt.Println("No migrations applied")
+		return
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%d	%s\n", timestamp, description)
+}
@@ -1,2 +1,2 @@
-go build
+go build ./cmd/pgmigrate
 mv pgmigrate ~/bin
@@ -0,0 +1,183 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lib/pq"
+)
+
+//appliedChecksum is a changelog row with the checksum recorded when it was applied
+type appliedChecksum struct {
+	timestamp   int64
+	description string
+	checksum    sql.NullString
+}
+
+//appliedChecksums reads the checksum of every migration recorded in the changelog
+func appliedChecksums() []appliedChecksum {
+	applied, err := readAppliedChecksums(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return applied
+}
+
+//readAppliedChecksums is appliedChecksums returning errors
+func readAppliedChecksums(ctx context.Context) ([]appliedChecksum, error) {
+	//--sql-only renders statements as if against a database with no migrations applied
+	if sqlOnly {
+		return nil, nil
+	}
+	c := GetConfig()
+	query := fmt.Sprintf("SELECT %s, description, checksum FROM %s ORDER BY %s", c.TimestampColumn(), c.quotedChangelogTable(), c.TimestampColumn())
+	rows, err := getChangelogDb().QueryContext(ctx, query)
+	if err != nil {
+		if isUndefinedTable(err) {
+			return nil, nil
+		}
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "undefined_column" {
+			return nil, fmt.Errorf("%s has no checksum column, checksums were never recorded. Run 'pgmigrate repair' to backfill them", c.ChangelogTable())
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []appliedChecksum
+	for rows.Next() {
+		var a appliedChecksum
+		if err = rows.Scan(&a.timestamp, &a.description, &a.checksum); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+//migrationsByTimestamp reads every migration file keyed by timestamp
+func migrationsByTimestamp() map[int64]Migration {
+	byTimestamp := make(map[int64]Migration)
+	for _, m := range ReadMigrationsFromFile() {
+		byTimestamp[m.Timestamp] = m
+	}
+	return byTimestamp
+}
+
+//VerifyOptions are the options of VerifyChecksums
+type VerifyOptions struct {
+	//MaxErrors stops the check once this many mismatches have been found, 0 meaning no limit
+	MaxErrors int
+}
+
+//VerifyChecksums compares the checksum recorded for every applied migration with the
+//checksum of its file and exits with a non-zero status if any differ
+func VerifyChecksums(opts VerifyOptions) {
+	applied := appliedChecksums()
+	files := migrationsByTimestamp()
+
+	var mismatches []string
+	unrecorded := 0
+	checked := 0
+	for _, a := range applied {
+		if opts.MaxErrors > 0 && len(mismatches) >= opts.MaxErrors {
+			break
+		}
+		checked++
+		if !a.checksum.Valid {
+			unrecorded++
+			continue
+		}
+		m, ok := files[a.timestamp]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%d %s: file missing", a.timestamp, a.description))
+			continue
+		}
+		if err := m.VerifyChecksum(a.checksum.String); err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%d %s: checksum mismatch", a.timestamp, a.description))
+		}
+	}
+
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if opts.MaxErrors > 0 && len(mismatches) >= opts.MaxErrors {
+		fmt.Printf("Stopped after %d mismatch(es), after checking %d of %d applied migration(s)\n", len(mismatches), checked, len(applied))
+		os.Exit(1)
+	}
+	if unrecorded > 0 {
+		fmt.Printf("%d applied migration(s) have no recorded checksum, run 'pgmigrate repair' to backfill them\n", unrecorded)
+	}
+	if len(mismatches) > 0 || unrecorded > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("OK, %d checksum(s) verified\n", len(applied))
+}
+
+//Repair records the checksum of the file of every applied migration that has none,
+//as for migrations applied by versions that did not record checksums
+func Repair() {
+	c := GetConfig()
+	CreateChangeLogTable()
+	files := migrationsByTimestamp()
+
+	updateSQL := fmt.Sprintf("UPDATE %s SET checksum = $1 WHERE %s = $2 AND checksum IS NULL", c.quotedChangelogTable(), c.TimestampColumn())
+	repaired := 0
+	for _, a := range appliedChecksums() {
+		if a.checksum.Valid {
+			continue
+		}
+		m, ok := files[a.timestamp]
+		if !ok {
+			log.Printf("Warning: no file for applied migration %d %s, leaving its checksum empty", a.timestamp, a.description)
+			continue
+		}
+		if _, err := getChangelogDb().Exec(updateSQL, m.Checksum(), m.Timestamp); err != nil {
+			log.Fatalln(err)
+		}
+		repaired++
+	}
+	log.Printf("Recorded %d checksum(s)", repaired)
+}
+
+//CheckDrift logs every applied migration whose file changed since it was applied and
+//exits if there are any, unless allowDirty is set. Migrations applied without a recorded
+//checksum are not checked.
+func CheckDrift(ms Migrations, allowDirty bool) {
+	if err := checkDrift(context.Background(), ms, allowDirty); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//checkDrift is CheckDrift returning an error
+func checkDrift(ctx context.Context, ms Migrations, allowDirty bool) error {
+	files := make(map[int64]Migration)
+	for _, m := range ms {
+		files[m.Timestamp] = m
+	}
+
+	applied, err := readAppliedChecksums(ctx)
+	if err != nil {
+		return err
+	}
+	dirty := 0
+	for _, a := range applied {
+		m, ok := files[a.timestamp]
+		if !ok || !a.checksum.Valid {
+			continue
+		}
+		if err := m.LoadScripts(); err != nil {
+			return err
+		}
+		if err := m.VerifyChecksum(a.checksum.String); err != nil {
+			log.Printf("Checksum mismatch, %s was edited after it was applied", m.Filename)
+			dirty++
+		}
+	}
+	if dirty > 0 && !allowDirty {
+		return fmt.Errorf("%w: refusing to run, %d applied migration(s) were edited. Restore them or use --allow-dirty to override", ErrChecksumMismatch, dirty)
+	}
+	return nil
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/joshkamau/pgmigrate"
+)
+
+//command is a pgmigrate subcommand
+type command struct {
+	name string
+	//aliases are other names the command can be run by
+	aliases []string
+	//usage shows the command's arguments, e.g. "up [n]"
+	usage string
+	short string
+	//example is a sample invocation shown in the command's help
+	example string
+	//flags registers the command's own flags
+	flags func(fs *flag.FlagSet)
+	//run executes the command with its positional arguments
+	run func(c *command, args []string)
+	//cancellable commands run with a ctx cancelled by SIGINT or SIGTERM, the others keep
+	//the default handling and exit on the signal
+	cancellable bool
+
+	fs *flag.FlagSet
+}
+
+//commands lists every command in the order they are shown in the usage
+var commands = []*command{
+	initCommand(),
+	newCommand(),
+	createCommand(),
+	functionCommand(),
+	runFunctionsCommand(),
+	upCommand(),
+	downCommand(),
+	redoCommand(),
+	gotoCommand(),
+	forceCommand(),
+	statusCommand(),
+	historyCommand(),
+	versionCommand(),
+	lintCommand(),
+	previewCommand(),
+	dumpSchemaCommand(),
+	rebaseCommand(),
+	verifyChecksumsCommand(),
+	repairCommand(),
+	stampCommentCommand(),
+	readStampCommand(),
+}
+
+//workDir is the directory holding pgmigrate.json and the scripts folder, set with --dir
+var workDir string
+
+//ctx is the context cancellable commands run with, cancelled by SIGINT or SIGTERM
+var ctx = context.Background()
+
+//options holds the global flags, passed to pgmigrate once they have been parsed
+var options = pgmigrate.Options{ConfigFile: pgmigrate.DefaultConfigFile, Vars: map[string]string{}}
+
+//varFlag collects repeated --var key=value flags into a map
+type varFlag map[string]string
+
+func (v varFlag) String() string {
+	var pairs []string
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	v[key] = value
+	return nil
+}
+
+func init() {
+	//help is added here because it refers back to the commands list
+	commands = append(commands, helpCommand())
+}
+
+//globalFlags registers the flags accepted by every command. The current values are
+//used as defaults so registering them again keeps anything already parsed.
+func globalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&workDir, "dir", workDir, "run in this `directory` instead of the current one")
+	fs.StringVar(&options.ConfigFile, "config", options.ConfigFile, "`path` of the config file")
+	fs.StringVar(&options.Dsn, "dsn", options.Dsn, "connection string used instead of the connection details in the config file")
+	fs.BoolVar(&options.ReadOnly, "read-only", options.ReadOnly, "make the session read-only and refuse commands that write to the database")
+	fs.BoolVar(&options.Verbose, "verbose", options.Verbose, "log every statement before it is executed, how long it took and the transaction boundaries")
+	fs.BoolVar(&options.SQLOnly, "sql-only", options.SQLOnly, "print every statement that would run, including bookkeeping, without touching the database")
+	fs.BoolVar(&options.DryRun, "dry-run", options.DryRun, "print the scripts and changelog statements up or down would run, reading the changelog but changing nothing")
+	fs.BoolVar(&options.JSONLogs, "json-logs", options.JSONLogs, "stream a JSON progress event to stderr for each migration during up, down, redo and goto")
+	fs.StringVar(&options.Table, "table", options.Table, "`name` of the changelog table, overrides migrationTableName in pgmigrate.json")
+	fs.StringVar(&options.Stream, "stream", options.Stream, "`name` of the migration stream, with its own changelog table and scripts/<name> directory")
+	fs.StringVar(&options.Environment, "env", options.Environment, "environment migrations run in, overrides \"environment\" in pgmigrate.json")
+	fs.Var(varFlag(options.Vars), "var", "`key=value` template variable for migration scripts, overrides \"vars\" in pgmigrate.json, may be repeated")
+}
+
+func initCommand() *command {
+	var scriptsDir string
+	var withExample bool
+	return &command{
+		name:    "init",
+		usage:   "init [path]",
+		short:   "Initializes an empty directory, the current one by default, with a pgmigrate.json and scripts folder.",
+		example: `pgmigrate init --scripts-dir db/migrations .`,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&scriptsDir, "scripts-dir", pgmigrate.DefaultScriptsDir, "`directory` for the migration scripts, saved as scriptsDir in pgmigrate.json")
+			fs.BoolVar(&withExample, "with-example", false, "also write an example migration and function showing the file formats")
+		},
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 1)
+			path := "."
+			if len(args) > 0 {
+				path = args[0]
+			}
+			pgmigrate.InitMigration(path, scriptsDir, withExample)
+		},
+	}
+}
+
+func newCommand() *command {
+	var fromDiff string
+	return &command{
+		name:    "new",
+		usage:   "new [--from-diff <old> <new>] <description>",
+		short:   "Creates a new migration with the provided description.",
+		example: `pgmigrate new --from-diff before.schema after.schema add orders table`,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&fromDiff, "from-diff", "", "generate the scripts from the differences between this schema dump and the one given as the first argument")
+		},
+		run: func(c *command, args []string) {
+			if fromDiff != "" {
+				if len(args) < 2 {
+					c.fail("expected the new schema dump and a description")
+				}
+				pgmigrate.NewMigrationFromDiff(fromDiff, args[0], strings.Join(args[1:], " "))
+				return
+			}
+			if len(args) == 0 {
+				c.fail("missing description")
+			}
+			pgmigrate.NewMigration(strings.Join(args, " "))
+		},
+	}
+}
+
+//migrationNameRe matches the names accepted by create, which become the file name as is
+var migrationNameRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func createCommand() *command {
+	return &command{
+		name:    "create",
+		usage:   "create <name>",
+		short:   "Creates a new migration named <timestamp>_<name>.sql, where name is a lower case slug.",
+		example: `pgmigrate create add_orders_table`,
+		run: func(c *command, args []string) {
+			if len(args) == 0 {
+				c.fail("missing name")
+			}
+			if len(args) > 1 || !migrationNameRe.MatchString(args[0]) {
+				c.fail(fmt.Sprintf("invalid name %q, use lower case letters, digits, _ and -, e.g. %s", strings.Join(args, " "), slug(strings.Join(args, " "))))
+			}
+			pgmigrate.NewMigration(args[0])
+		},
+	}
+}
+
+//slug suggests a name accepted by create for an invalid one
+func slug(name string) string {
+	name = strings.ToLower(strings.Join(strings.Fields(name), "_"))
+	return regexp.MustCompile(`[^a-z0-9_-]+`).ReplaceAllString(name, "")
+}
+
+func dumpSchemaCommand() *command {
+	return &command{
+		name:    "dump-schema",
+		usage:   "dump-schema",
+		short:   "Prints the tables, columns and indexes of the database, for new --from-diff.",
+		example: "pgmigrate dump-schema > before.schema",
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			pgmigrate.DumpSchema()
+		},
+	}
+}
+
+func functionCommand() *command {
+	return &command{
+		name:    "function",
+		usage:   "function <description>",
+		short:   "Creates a new function file with the provided description.",
+		example: `pgmigrate function calculate totals`,
+		run: func(c *command, args []string) {
+			if len(args) == 0 {
+				c.fail("missing description")
+			}
+			pgmigrate.NewFunction(strings.Join(args, " "))
+		},
+	}
+}
+
+func runFunctionsCommand() *command {
+	var force, changedOnly bool
+	return &command{
+		name:    "run-functions",
+		usage:   "run-functions",
+		short:   "Runs the function scripts that changed since they were last run, or all of them with --force.",
+		example: `pgmigrate run-functions --force`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&force, "force", false, "run every function, including those whose script has not changed since they were last run")
+			//unchanged functions are skipped by default, the flag is kept for existing scripts
+			fs.BoolVar(&changedOnly, "changed-only", false, "deprecated, only changed functions are run by default")
+		},
+		cancellable: true,
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			c.requireWritable()
+			pgmigrate.RunFunctions(ctx, force)
+		},
+	}
+}
+
+func upCommand() *command {
+	var opts pgmigrate.UpOptions
+	var targetVersionFile string
+	var steps int64
+	return &command{
+		name:    "up",
+		usage:   "up [n|all]",
+		short:   "Runs unapplied migrations, all of them by default or with all, or n.",
+		example: `pgmigrate up --steps 2`,
+		flags: func(fs *flag.FlagSet) {
+			fs.Int64Var(&steps, "steps", 0, "apply at most this `number` of migrations, the same as giving n")
+			fs.Int64Var(&opts.ContinueFrom, "continue-from", 0, "skip pending migrations older than this `timestamp`, warning about any never applied")
+			fs.BoolVar(&opts.Force, "force", false, "run even if many applied migrations have no file")
+			fs.DurationVar(&opts.UntilDuration, "until-duration", 0, "stop before a migration that could run past this `duration`, e.g. 10m")
+			fs.BoolVar(&opts.ReportSkipped, "report-skipped", false, "list pending migrations that will be skipped or applied out of order before applying any")
+			fs.BoolVar(&opts.AllowDirty, "allow-dirty", false, "run even if applied migrations were edited since they were applied")
+			fs.StringVar(&opts.SummaryJSON, "summary-json", "", "write a JSON summary of the run to this `path`, - for stdout")
+			fs.StringVar(&targetVersionFile, "target-version-file", "", "apply migrations up to the timestamp read from this `file`")
+		},
+		cancellable: true,
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 1)
+			//up, up all and up 0 all apply every pending migration
+			opts.N, _ = c.stepsArg(args, steps)
+			if targetVersionFile != "" {
+				target, err := pgmigrate.ReadTargetVersion(targetVersionFile)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				opts.Target = target
+			}
+			if !options.DryRun {
+				c.requireWritable()
+			}
+			pgmigrate.Up(ctx, opts)
+		},
+	}
+}
+
+func downCommand() *command {
+	var opts pgmigrate.DownOptions
+	var steps int64
+	return &command{
+		name:    "down",
+		usage:   "down [n|all]",
+		short:   "Undoes migrations applied to the database, one by default, n, or all of them.",
+		example: `pgmigrate down --steps 2 --preview`,
+		flags: func(fs *flag.FlagSet) {
+			fs.Int64Var(&steps, "steps", 0, "undo this `number` of migrations, the same as giving n")
+			fs.BoolVar(&opts.Force, "force", false, "roll back past the protected baseline or migrations with an empty @UNDO, and run even if many applied migrations have no file")
+			fs.BoolVar(&opts.Preview, "preview", false, "list the migrations that would be undone without changing the database")
+		},
+		cancellable: true,
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 1)
+			n, all := c.stepsArg(args, steps)
+			switch {
+			case all:
+				opts.All = true
+			case len(args) == 0 && steps == 0:
+				opts.N = 1
+			case n == 0:
+				c.fail("down needs at least 1 migration to undo, or all")
+			default:
+				opts.N = n
+			}
+			if !opts.Preview && !options.DryRun {
+				c.requireWritable()
+			}
+			pgmigrate.Down(ctx, opts)
+		},
+	}
+}
+
+func redoCommand() *command {
+	var force bool
+	return &command{
+		name:    "redo",
+		usage:   "redo",
+		short:   "Undoes the most recently applied migration and applies it again.",
+		example: `pgmigrate redo`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&force, "force", false, "redo a migration at or before the protected baseline or with an empty @UNDO, and run even if many applied migrations have no file")
+		},
+		cancellable: true,
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			c.requireWritable()
+			pgmigrate.Redo(ctx, force)
+		},
+	}
+}
+
+func gotoCommand() *command {
+	var force bool
+	return &command{
+		name:    "goto",
+		usage:   "goto <timestamp>",
+		short:   "Applies or undoes migrations until the database is at the migration with this timestamp.",
+		example: `pgmigrate goto 1699999999`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&force, "force", false, "undo migrations at or before the protected baseline or with an empty @UNDO, and run even if many applied migrations have no file")
+		},
+		cancellable: true,
+		run: func(c *command, args []string) {
+			if len(args) != 1 {
+				c.fail("expected the timestamp of a migration")
+			}
+			target := c.timestampArg(args[0])
+			c.requireWritable()
+			pgmigrate.Goto(ctx, target, force)
+		},
+	}
+}
+
+func forceCommand() *command {
+	var remove bool
+	return &command{
+		name:    "force",
+		usage:   "force <timestamp>",
+		short:   "Records a migration as applied without running it, or with --remove as not applied.",
+		example: `pgmigrate force 1699999999`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&remove, "remove", false, "delete the migration's changelog row without running its @UNDO script")
+		},
+		run: func(c *command, args []string) {
+			if len(args) != 1 {
+				c.fail("expected the timestamp of a migration")
+			}
+			timestamp := c.timestampArg(args[0])
+			c.requireWritable()
+			pgmigrate.Force(timestamp, remove)
+		},
+	}
+}
+
+func versionCommand() *command {
+	return &command{
+		name:    "version",
+		usage:   "version",
+		short:   "Prints the timestamp and description of the latest applied migration.",
+		example: `pgmigrate version`,
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			pgmigrate.Version()
+		},
+	}
+}
+
+func statusCommand() *command {
+	var filesOnly bool
+	var opts pgmigrate.StatusOptions
+	var lintOpts pgmigrate.LintOptions
+	return &command{
+		name:    "status",
+		usage:   "status",
+		short:   "Prints every migration and whether it has been applied.",
+		example: `pgmigrate status --json | jq '.[] | select(.applied | not)'`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&filesOnly, "files-only", false, "check the migration files without connecting to the database, like lint")
+			fs.BoolVar(&opts.JSON, "json", false, "print the migrations as a JSON array of {timestamp, description, applied} objects")
+			fs.BoolVar(&opts.Pending, "pending", false, "list only the migrations that have not been applied")
+			fs.BoolVar(&opts.Applied, "applied", false, "list only the migrations that have been applied")
+		},
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			if filesOnly {
+				pgmigrate.Lint(lintOpts)
+				return
+			}
+			if opts.Pending && opts.Applied {
+				c.fail("--pending and --applied cannot be used together")
+			}
+			pgmigrate.Status(opts)
+		},
+	}
+}
+
+func historyCommand() *command {
+	var oldestFirst bool
+	return &command{
+		name:    "history",
+		usage:   "history",
+		short:   "Lists the migrations recorded in the changelog in the order they were applied, most recent first.",
+		example: `pgmigrate history --oldest-first`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&oldestFirst, "oldest-first", false, "list the first applied migration first")
+		},
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			pgmigrate.History(oldestFirst)
+		},
+	}
+}
+
+func lintCommand() *command {
+	var opts pgmigrate.LintOptions
+	return &command{
+		name:    "lint",
+		aliases: []string{"validate"},
+		usage:   "lint",
+		short:   "Checks every migration file without connecting to the database. Also available as validate.",
+		example: `pgmigrate lint --strict --max-errors 10`,
+		flags: func(fs *flag.FlagSet) {
+			fs.IntVar(&opts.MaxErrors, "max-errors", 0, "stop after `n` problems, 0 reports all of them")
+			fs.BoolVar(&opts.Strict, "strict", false, "treat warnings as problems")
+		},
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			if opts.MaxErrors < 0 {
+				c.fail("-max-errors must not be negative")
+			}
+			pgmigrate.Lint(opts)
+		},
+	}
+}
+
+func previewCommand() *command {
+	var shadowDsn string
+	return &command{
+		name:    "preview",
+		usage:   "preview <timestamp>",
+		short:   "Applies a migration to a scratch database and prints the schema changes it makes.",
+		example: `pgmigrate preview 1792057714 --shadow-dsn "dbname=scratch"`,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&shadowDsn, "shadow-dsn", "", "connection string of the scratch database, overrides shadowDsn in pgmigrate.json")
+		},
+		run: func(c *command, args []string) {
+			if len(args) != 1 {
+				c.fail("expected a migration timestamp")
+			}
+			pgmigrate.Preview(c.timestampArg(args[0]), shadowDsn)
+		},
+	}
+}
+
+func rebaseCommand() *command {
+	var yes bool
+	return &command{
+		name:    "rebase",
+		usage:   "rebase",
+		short:   "Renumbers pending migrations older than the latest applied one so they run last.",
+		example: `pgmigrate rebase --yes`,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&yes, "yes", false, "rename without asking for confirmation")
+		},
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			pgmigrate.Rebase(yes)
+		},
+	}
+}
+
+func helpCommand() *command {
+	return &command{
+		name:    "help",
+		usage:   "help [command]",
+		short:   "Lists the commands, or shows the flags and an example of one command.",
+		example: "pgmigrate help up",
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 1)
+			if len(args) == 0 {
+				fs := rootFlagSet()
+				fs.SetOutput(os.Stdout)
+				usage(fs)
+				return
+			}
+			topic := findCommand(args[0])
+			if topic == nil {
+				c.fail(fmt.Sprintf("unknown command %q", args[0]))
+			}
+			topic.flagSet().SetOutput(os.Stdout)
+			topic.printUsage()
+		},
+	}
+}
+
+func verifyChecksumsCommand() *command {
+	var opts pgmigrate.VerifyOptions
+	return &command{
+		name:    "verify-checksums",
+		aliases: []string{"verify"},
+		usage:   "verify-checksums",
+		short:   "Checks that the files of applied migrations still match the checksums recorded when they were applied. Also available as verify.",
+		example: "pgmigrate verify-checksums --max-errors 10",
+		flags: func(fs *flag.FlagSet) {
+			fs.IntVar(&opts.MaxErrors, "max-errors", 0, "stop after `n` mismatches, 0 reports all of them")
+		},
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			if opts.MaxErrors < 0 {
+				c.fail("-max-errors must not be negative")
+			}
+			pgmigrate.VerifyChecksums(opts)
+		},
+	}
+}
+
+func repairCommand() *command {
+	return &command{
+		name:    "repair",
+		usage:   "repair",
+		short:   "Records the checksums of applied migrations that have none.",
+		example: "pgmigrate repair",
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			c.requireWritable()
+			pgmigrate.Repair()
+		},
+	}
+}
+
+func stampCommentCommand() *command {
+	return &command{
+		name:    "stamp-comment",
+		usage:   "stamp-comment",
+		short:   "Stores the applied migrations in the comment of the changelog table, so pg_dump keeps them.",
+		example: "pgmigrate stamp-comment && pg_dump mydb > mydb.sql",
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			c.requireWritable()
+			pgmigrate.StampComment()
+		},
+	}
+}
+
+func readStampCommand() *command {
+	return &command{
+		name:    "read-stamp",
+		usage:   "read-stamp",
+		short:   "Prints the applied migrations stored by stamp-comment.",
+		example: "pgmigrate read-stamp",
+		run: func(c *command, args []string) {
+			c.maxArgs(args, 0)
+			pgmigrate.ReadStamp()
+		},
+	}
+}
+
+//fail reports a usage error for the command and exits
+func (c *command) fail(msg string) {
+	fmt.Fprintf(os.Stderr, "pgmigrate %s: %s\n", c.name, msg)
+	c.fs.Usage()
+	os.Exit(2)
+}
+
+//requireWritable fails if the command, which writes to the database, is run with --read-only
+//or --dry-run
+func (c *command) requireWritable() {
+	if options.ReadOnly {
+		c.fail("writes to the database and cannot run with --read-only")
+	}
+	if options.DryRun {
+		c.fail("writes to the database and cannot run with --dry-run, which only up and down support; use --sql-only to print its statements")
+	}
+}
+
+//maxArgs fails if more than max positional arguments were given
+func (c *command) maxArgs(args []string, max int) {
+	if len(args) > max {
+		c.fail("unexpected arguments: " + strings.Join(args[max:], " "))
+	}
+}
+
+//countArg parses the optional number of migrations, 0 when it is absent
+func (c *command) countArg(args []string) int64 {
+	if len(args) == 0 {
+		return 0
+	}
+	n, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || n < 0 {
+		c.fail(fmt.Sprintf("invalid number of migrations %q", args[0]))
+	}
+	return n
+}
+
+//stepsArg returns the number of migrations given as the optional argument or with --steps,
+//0 when neither is given, and whether the argument is all
+func (c *command) stepsArg(args []string, steps int64) (int64, bool) {
+	if steps < 0 {
+		c.fail(fmt.Sprintf("invalid number of migrations %d", steps))
+	}
+	if len(args) == 0 {
+		return steps, false
+	}
+	if steps > 0 {
+		c.fail("give the number of migrations as an argument or with --steps, not both")
+	}
+	if args[0] == "all" {
+		return 0, true
+	}
+	return c.countArg(args), false
+}
+
+//timestampArg parses a migration timestamp argument
+func (c *command) timestampArg(arg string) int64 {
+	timestamp, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		c.fail(fmt.Sprintf("invalid timestamp %q", arg))
+	}
+	return timestamp
+}
+
+//printUsage prints the command's usage and its own flags
+func (c *command) printUsage() {
+	out := c.fs.Output()
+	fmt.Fprintf(out, "usage: pgmigrate %s [flags]\n\n%s\n", c.usage, c.short)
+	fmt.Fprintf(out, "\nExample:\n  %s\n", c.example)
+
+	//list the command's flags apart from the global ones shown by 'pgmigrate -h'
+	global := flag.NewFlagSet("global", flag.ContinueOnError)
+	globalFlags(global)
+	own := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	own.SetOutput(out)
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if global.Lookup(f.Name) == nil {
+			own.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	hasFlags := false
+	own.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintln(out, "\nFlags:")
+		own.PrintDefaults()
+	}
+}
+
+//parseArgs parses flags wherever they appear among args and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		//errors exit because the flag sets are created with flag.ExitOnError
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+//usage prints the list of commands and the global flags
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintln(out, "usage: pgmigrate [flags] <command> [arguments]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-22s %s\n", c.usage, c.short)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	fs.PrintDefaults()
+	fmt.Fprintln(out, "\nRun 'pgmigrate help <command>' for the flags and an example of a command.")
+}
+
+//findCommand returns the command called name, or with name as an alias, or nil if there is none
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+//rootFlagSet creates the flag set for the flags given before the command
+func rootFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("pgmigrate", flag.ExitOnError)
+	globalFlags(fs)
+	fs.Usage = func() { usage(fs) }
+	return fs
+}
+
+//flagSet creates the command's flag set holding the global flags and its own
+func (c *command) flagSet() *flag.FlagSet {
+	c.fs = flag.NewFlagSet(c.name, flag.ExitOnError)
+	globalFlags(c.fs)
+	if c.flags != nil {
+		c.flags(c.fs)
+	}
+	c.fs.Usage = c.printUsage
+	return c.fs
+}
+
+func main() {
+	fs := rootFlagSet()
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.SetOutput(os.Stdout)
+		usage(fs)
+		return
+	}
+
+	c := findCommand(fs.Arg(0))
+	if c == nil {
+		log.Printf("Invalid command %q.", fs.Arg(0))
+		usage(fs)
+		os.Exit(2)
+	}
+
+	args := parseArgs(c.flagSet(), fs.Args()[1:])
+	//a --config path is relative to where pgmigrate was started, the default one to --dir
+	if options.ConfigFile != pgmigrate.DefaultConfigFile {
+		path, err := filepath.Abs(options.ConfigFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		options.ConfigFile = path
+	}
+	if workDir != "" {
+		if err := os.Chdir(workDir); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	pgmigrate.SetOptions(options)
+
+	//the first Ctrl-C cancels the statement being run so its transaction rolls back, a
+	//second one exits straight away
+	if c.cancellable {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-ctx.Done()
+			stop()
+			log.Println("Interrupted, cancelling the current statement ...")
+		}()
+	}
+	c.run(c, args)
+}
@@ -0,0 +1,94 @@
+package pgmigrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Errors callers can test for with errors.Is
+var (
+	//ErrConnect is returned when the database cannot be reached
+	ErrConnect = errors.New("pgmigrate: unable to connect to the database")
+	//ErrMigrationFailed is matched by every MigrationError
+	ErrMigrationFailed = errors.New("pgmigrate: migration failed")
+	//ErrOutOfOrder is returned when a pending migration is older than the latest applied one
+	//and outOfOrder is strict
+	ErrOutOfOrder = errors.New("pgmigrate: migration out of order")
+	//ErrLockHeld is returned when another run holds the migration lock
+	ErrLockHeld = errors.New("pgmigrate: migration lock held by another run")
+	//ErrChecksumMismatch is returned when an applied migration's file has changed since it was applied
+	ErrChecksumMismatch = errors.New("pgmigrate: checksum mismatch")
+	//ErrNoScriptsDir is returned when the scripts or functions directory does not exist
+	ErrNoScriptsDir = errors.New("pgmigrate: no scripts directory found")
+)
+
+//MigrationError is returned when applying or undoing a migration fails. Use errors.As to
+//get the migration and errors.Is(err, ErrMigrationFailed) to test for it.
+type MigrationError struct {
+	Migration Migration
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("migration %d %s failed: %v", e.Migration.Timestamp, e.Migration.Description, e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+//Is makes every MigrationError match ErrMigrationFailed
+func (e *MigrationError) Is(target error) bool {
+	return target == ErrMigrationFailed
+}
+
+//FileErrors holds the problems found reading the migration files, one per file, so that
+//a malformed file does not hide the problems of the others
+type FileErrors []error
+
+func (e FileErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+//Connect checks that the database can be reached, returning an error wrapping ErrConnect
+//if it cannot
+func Connect() error {
+	return connect(context.Background())
+}
+
+//connect is Connect taking a context
+func connect(ctx context.Context) error {
+	pool, err := getDbContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := pool.PingContext(ctx); err != nil {
+		return connectError(ctx, err)
+	}
+	return nil
+}
+
+//connectError wraps err, the error getting a connection, with ErrConnect unless it
+//failed because ctx ended
+func connectError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: %v", ErrConnect, err)
+}
+
+//VerifyChecksum compares the migration's checksum with the one recorded when it was
+//applied, returning an error wrapping ErrChecksumMismatch if they differ. Checksums
+//recorded before marker lines were left out of the scripts are accepted too.
+func (m *Migration) VerifyChecksum(recorded string) error {
+	if m.Checksum() != recorded && m.legacyChecksum() != recorded {
+		return fmt.Errorf("%w: %d %s", ErrChecksumMismatch, m.Timestamp, m.Description)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//fakeDB stands in for postgres in tests. It keeps the rows of the "changelog" table,
+//logs every statement it is sent and runs no SQL, so the migrations of a test only need
+//to be statements the test wants to see.
+type fakeDB struct {
+	mu sync.Mutex
+	//applied holds the committed changelog rows, timestamp to checksum
+	applied map[int64]string
+	log     []fakeStatement
+	//connectErr, when set, is returned for every new connection
+	connectErr error
+	//onExec, when set, is called with each statement of a migration script before it runs
+	//and fails the statement with the error it returns
+	onExec func(query string) error
+}
+
+//fakeStatement is a statement sent to a fakeDB and whether it ran in a transaction
+type fakeStatement struct {
+	query string
+	inTx  bool
+}
+
+//changelogOp is a changelog INSERT or DELETE waiting for its transaction to commit
+type changelogOp struct {
+	insert    bool
+	timestamp int64
+	checksum  string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{applied: make(map[int64]string)}
+}
+
+//statements returns the statements logged so far
+func (f *fakeDB) statements() []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeStatement(nil), f.log...)
+}
+
+//migrationStatements returns the statements of migration scripts logged so far, leaving
+//out the changelog bookkeeping, the migration lock and transaction control
+func (f *fakeDB) migrationStatements() []string {
+	var queries []string
+	for _, s := range f.statements() {
+		if !isBookkeeping(s.query) {
+			queries = append(queries, s.query)
+		}
+	}
+	return queries
+}
+
+//appliedTimestamps returns the committed changelog timestamps
+func (f *fakeDB) appliedTimestamps() map[int64]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	applied := make(map[int64]bool)
+	for timestamp := range f.applied {
+		applied[timestamp] = true
+	}
+	return applied
+}
+
+//isBookkeeping checks if query is one pgmigrate sends itself rather than part of a script
+func isBookkeeping(query string) bool {
+	switch query {
+	case "BEGIN", "COMMIT", "ROLLBACK":
+		return true
+	}
+	return strings.Contains(query, `"changelog"`) || strings.HasPrefix(query, "SELECT pg_")
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) {
+	if f.connectErr != nil {
+		return nil, f.connectErr
+	}
+	return &fakeConn{db: f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return fakeDriver{f}
+}
+
+type fakeDriver struct {
+	db *fakeDB
+}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+	return d.db.Connect(context.Background())
+}
+
+//fakeConn is a session of a fakeDB, with the changelog changes of its open transaction
+type fakeConn struct {
+	db      *fakeDB
+	inTx    bool
+	pending []changelogOp
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.record("BEGIN")
+	c.inTx = true
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) record(query string) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.log = append(c.db.log, fakeStatement{query: query, inTx: c.inTx})
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	//like lib/pq, statements are not sent once ctx is done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query = strings.TrimSpace(query)
+	c.record(query)
+	//like postgres, which cannot build an index concurrently in a transaction block
+	if c.inTx && strings.Contains(query, "CONCURRENTLY") {
+		return nil, errors.New("pq: CREATE INDEX CONCURRENTLY cannot run inside a transaction block")
+	}
+	if c.db.onExec != nil && !isBookkeeping(query) {
+		if err := c.db.onExec(query); err != nil {
+			return nil, err
+		}
+	}
+	var op *changelogOp
+	switch {
+	case strings.HasPrefix(query, `INSERT INTO "changelog"`):
+		checksum, _ := args[2].Value.(string)
+		op = &changelogOp{insert: true, timestamp: args[0].Value.(int64), checksum: checksum}
+	case strings.HasPrefix(query, `DELETE FROM "changelog"`):
+		op = &changelogOp{timestamp: args[0].Value.(int64)}
+	}
+	if op != nil {
+		if c.inTx {
+			c.pending = append(c.pending, *op)
+		} else {
+			c.db.apply([]changelogOp{*op})
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query = strings.TrimSpace(query)
+	c.record(query)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT pg_try_advisory_lock"):
+		return &fakeRows{columns: []string{"locked"}, rows: [][]driver.Value{{true}}}, nil
+	case strings.HasPrefix(query, "SELECT COUNT(*)"):
+		count := int64(0)
+		if _, ok := c.db.applied[args[0].Value.(int64)]; ok {
+			count = 1
+		}
+		return &fakeRows{columns: []string{"count"}, rows: [][]driver.Value{{count}}}, nil
+	case strings.Contains(query, "description, checksum FROM"):
+		rows := &fakeRows{columns: []string{"timestamp", "description", "checksum"}}
+		for timestamp, checksum := range c.db.applied {
+			var value driver.Value
+			if checksum != "" {
+				value = checksum
+			}
+			rows.rows = append(rows.rows, []driver.Value{timestamp, "", value})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT timestamp FROM"):
+		rows := &fakeRows{columns: []string{"timestamp"}}
+		for timestamp := range c.db.applied {
+			rows.rows = append(rows.rows, []driver.Value{timestamp})
+		}
+		return rows, nil
+	}
+	return &fakeRows{columns: []string{"?"}}, nil
+}
+
+//apply makes committed changelog changes visible
+func (f *fakeDB) apply(ops []changelogOp) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, op := range ops {
+		if op.insert {
+			f.applied[op.timestamp] = op.checksum
+		} else {
+			delete(f.applied, op.timestamp)
+		}
+	}
+}
+
+type fakeTx struct {
+	c *fakeConn
+}
+
+func (tx fakeTx) Commit() error {
+	tx.c.inTx = false
+	tx.c.record("COMMIT")
+	tx.c.db.apply(tx.c.pending)
+	tx.c.pending = nil
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.c.inTx = false
+	tx.c.record("ROLLBACK")
+	tx.c.pending = nil
+	return nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+//newTestMigrator writes files to a scripts directory and returns a Migrator running them
+//against a fakeDB. The package state the Migrator sets is reset when the test ends.
+func newTestMigrator(tb testing.TB, files map[string]string) (*Migrator, *fakeDB) {
+	dir := tb.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	fake := newFakeDB()
+	m, err := New(sql.OpenDB(fake), &Config{MigrationTableName: "changelog", ScriptsDir: dir})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(resetOptions)
+	return m, fake
+}
+
+//resetOptions puts the package state back the way a program starts with it
+func resetOptions() {
+	db = nil
+	changelogDb = nil
+	conf = nil
+	unvalidatedConf = nil
+	SetOptions(Options{})
+}
@@ -0,0 +1,327 @@
+package pgmigrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//schemaColumn is a column line of a schema dump
+type schemaColumn struct {
+	table    string
+	name     string
+	dataType string
+	notNull  bool
+	def      string
+}
+
+//schemaIndex is an index line of a schema dump
+type schemaIndex struct {
+	table string
+	name  string
+	def   string
+}
+
+//schemaDump is a schema as captured by CaptureSchema, keyed by object
+type schemaDump struct {
+	tables  map[string]bool
+	columns map[string]schemaColumn
+	indexes map[string]schemaIndex
+}
+
+//parseSchemaDump parses the lines written by dump-schema
+func parseSchemaDump(lines []string) (*schemaDump, error) {
+	d := &schemaDump{
+		tables:  make(map[string]bool),
+		columns: make(map[string]schemaColumn),
+		indexes: make(map[string]schemaIndex),
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch {
+		case fields[0] == "table" && len(fields) == 2:
+			d.tables[fields[1]] = true
+		case fields[0] == "column" && len(fields) == 6:
+			col := schemaColumn{table: fields[1], name: fields[2], dataType: fields[3], notNull: fields[4] == "NOT NULL", def: fields[5]}
+			d.columns[col.table+"\t"+col.name] = col
+		case fields[0] == "index" && len(fields) == 4:
+			idx := schemaIndex{table: fields[1], name: fields[2], def: fields[3]}
+			d.indexes[idx.table+"\t"+idx.name] = idx
+		default:
+			return nil, fmt.Errorf("line %d: not a schema dump line: %q", i+1, line)
+		}
+	}
+	return d, nil
+}
+
+//readSchemaDump reads a file written by dump-schema
+func readSchemaDump(path string) (*schemaDump, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseSchemaDump(strings.Split(strings.Replace(string(content), "\r\n", "\n", -1), "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return d, nil
+}
+
+var plainNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+//sqlName quotes the parts of a possibly schema qualified name that need quoting
+func sqlName(name string) string {
+	parts := strings.SplitN(name, ".", 2)
+	for i, part := range parts {
+		if !plainNameRe.MatchString(part) {
+			parts[i] = pq.QuoteIdentifier(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+//indexName returns the schema qualified name of an index, which lives in its table's schema
+func indexName(idx schemaIndex) string {
+	if i := strings.Index(idx.table, "."); i >= 0 {
+		return sqlName(idx.table[:i] + "." + idx.name)
+	}
+	return sqlName(idx.name)
+}
+
+//columnDefinition renders a column as it appears in CREATE TABLE and ADD COLUMN
+func columnDefinition(col schemaColumn) string {
+	def := sqlName(col.name) + " " + col.dataType
+	if col.notNull {
+		def += " NOT NULL"
+	}
+	if col.def != "" {
+		def += " DEFAULT " + col.def
+	}
+	return def
+}
+
+//sequenceTodo warns about a default that uses a sequence, which schema dumps do not include
+func sequenceTodo(col schemaColumn) string {
+	if strings.Contains(col.def, "nextval(") {
+		return fmt.Sprintf("-- TODO: %s.%s uses a sequence, create it first or use SERIAL/IDENTITY\n", col.table, col.name)
+	}
+	return ""
+}
+
+//createTable renders CREATE TABLE for a table with the given columns
+func createTable(table string, columns []schemaColumn) string {
+	var b strings.Builder
+	for _, col := range columns {
+		b.WriteString(sequenceTodo(col))
+	}
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		defs[i] = "    " + columnDefinition(col)
+	}
+	b.WriteString(fmt.Sprintf("CREATE TABLE %s (\n%s\n);\n", sqlName(table), strings.Join(defs, ",\n")))
+	return b.String()
+}
+
+//tableColumns returns the columns of a table in name order
+func (d *schemaDump) tableColumns(table string) []schemaColumn {
+	var columns []schemaColumn
+	for _, col := range d.columns {
+		if col.table == table {
+			columns = append(columns, col)
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns
+}
+
+//sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//GenerateMigrationFromDiff writes the statements that turn the schema in the before dump
+//into the one in the after dump, and a best effort script undoing them. Only added and
+//removed tables, columns and indexes, and column type, nullability and default changes are
+//handled; anything that needs checking is marked with a TODO comment.
+func GenerateMigrationFromDiff(before *schemaDump, after *schemaDump) (doScript string, undoScript string) {
+	var do, undo strings.Builder
+	//undo statements are collected in order and written in reverse
+	var undoSteps []string
+
+	//tables added, with their columns
+	for _, table := range sortedKeys(after.tables) {
+		if before.tables[table] {
+			continue
+		}
+		if do.Len() == 0 {
+			do.WriteString("-- TODO: primary keys, foreign keys and check constraints are not in schema dumps, add them by hand\n")
+		}
+		do.WriteString(createTable(table, after.tableColumns(table)))
+		undoSteps = append(undoSteps, fmt.Sprintf("DROP TABLE %s;\n", sqlName(table)))
+	}
+
+	//columns added, removed or changed in tables that exist in both
+	columnKeys := make(map[string]bool)
+	for k := range before.columns {
+		columnKeys[k] = true
+	}
+	for k := range after.columns {
+		columnKeys[k] = true
+	}
+	for _, k := range sortedKeys(columnKeys) {
+		oldCol, inBefore := before.columns[k]
+		newCol, inAfter := after.columns[k]
+		table := newCol.table
+		if !inAfter {
+			table = oldCol.table
+		}
+		if !before.tables[table] || !after.tables[table] {
+			continue
+		}
+		alter := "ALTER TABLE " + sqlName(table)
+		switch {
+		case !inBefore:
+			do.WriteString(sequenceTodo(newCol))
+			if newCol.notNull && newCol.def == "" {
+				do.WriteString(fmt.Sprintf("-- TODO: %s.%s is NOT NULL without a default, this fails if the table has rows\n", table, newCol.name))
+			}
+			do.WriteString(fmt.Sprintf("%s ADD COLUMN %s;\n", alter, columnDefinition(newCol)))
+			undoSteps = append(undoSteps, fmt.Sprintf("%s DROP COLUMN %s;\n", alter, sqlName(newCol.name)))
+		case !inAfter:
+			do.WriteString(fmt.Sprintf("%s DROP COLUMN %s;\n", alter, sqlName(oldCol.name)))
+			undoSteps = append(undoSteps, sequenceTodo(oldCol)+fmt.Sprintf("-- TODO: the data in %s.%s is not restored\n%s ADD COLUMN %s;\n", table, oldCol.name, alter, columnDefinition(oldCol)))
+		default:
+			name := sqlName(newCol.name)
+			if oldCol.dataType != newCol.dataType {
+				do.WriteString(fmt.Sprintf("-- TODO: check the conversion from %s, add USING if postgres cannot cast it\n", oldCol.dataType))
+				do.WriteString(fmt.Sprintf("%s ALTER COLUMN %s TYPE %s;\n", alter, name, newCol.dataType))
+				undoSteps = append(undoSteps, fmt.Sprintf("%s ALTER COLUMN %s TYPE %s;\n", alter, name, oldCol.dataType))
+			}
+			if oldCol.notNull != newCol.notNull {
+				do.WriteString(fmt.Sprintf("%s ALTER COLUMN %s %s NOT NULL;\n", alter, name, setOrDrop(newCol.notNull)))
+				undoSteps = append(undoSteps, fmt.Sprintf("%s ALTER COLUMN %s %s NOT NULL;\n", alter, name, setOrDrop(oldCol.notNull)))
+			}
+			if oldCol.def != newCol.def {
+				do.WriteString(alterDefault(alter, name, newCol.def))
+				undoSteps = append(undoSteps, alterDefault(alter, name, oldCol.def))
+			}
+		}
+	}
+
+	//indexes added and removed, including those of new and dropped tables
+	indexKeys := make(map[string]bool)
+	for k := range before.indexes {
+		indexKeys[k] = true
+	}
+	for k := range after.indexes {
+		indexKeys[k] = true
+	}
+	for _, k := range sortedKeys(indexKeys) {
+		oldIdx, inBefore := before.indexes[k]
+		newIdx, inAfter := after.indexes[k]
+		if inBefore && inAfter && oldIdx.def == newIdx.def {
+			continue
+		}
+		if inBefore && after.tables[oldIdx.table] {
+			do.WriteString(fmt.Sprintf("DROP INDEX %s;\n", indexName(oldIdx)))
+			undoSteps = append(undoSteps, oldIdx.def+";\n")
+		}
+		if inAfter {
+			if strings.HasSuffix(newIdx.name, "_pkey") {
+				do.WriteString(fmt.Sprintf("-- TODO: %s backs a primary key, consider ALTER TABLE ... ADD PRIMARY KEY instead\n", newIdx.name))
+			}
+			do.WriteString(newIdx.def + ";\n")
+			if before.tables[newIdx.table] {
+				undoSteps = append(undoSteps, fmt.Sprintf("DROP INDEX %s;\n", indexName(newIdx)))
+			}
+		}
+	}
+
+	//tables removed, last so their indexes and columns are gone with them
+	for _, table := range sortedKeys(before.tables) {
+		if after.tables[table] {
+			continue
+		}
+		do.WriteString(fmt.Sprintf("DROP TABLE %s;\n", sqlName(table)))
+		step := fmt.Sprintf("-- TODO: the data in %s is not restored\n", table) + createTable(table, before.tableColumns(table))
+		for _, k := range sortedKeys(indexKeysOf(before, table)) {
+			step += before.indexes[k].def + ";\n"
+		}
+		undoSteps = append(undoSteps, step)
+	}
+
+	for i := len(undoSteps) - 1; i >= 0; i-- {
+		undo.WriteString(undoSteps[i])
+	}
+	return strings.TrimRight(do.String(), "\n"), strings.TrimRight(undo.String(), "\n")
+}
+
+//indexKeysOf returns the keys of the indexes on a table
+func indexKeysOf(d *schemaDump, table string) map[string]bool {
+	keys := make(map[string]bool)
+	for k, idx := range d.indexes {
+		if idx.table == table {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+//setOrDrop returns the ALTER COLUMN keyword that sets or drops an attribute
+func setOrDrop(set bool) string {
+	if set {
+		return "SET"
+	}
+	return "DROP"
+}
+
+//alterDefault renders the statement setting or dropping a column default
+func alterDefault(alter string, column string, def string) string {
+	if def == "" {
+		return fmt.Sprintf("%s ALTER COLUMN %s DROP DEFAULT;\n", alter, column)
+	}
+	return fmt.Sprintf("%s ALTER COLUMN %s SET DEFAULT %s;\n", alter, column, def)
+}
+
+//NewMigrationFromDiff creates a new migration whose scripts are generated from the
+//differences between two schema dumps written by dump-schema
+func NewMigrationFromDiff(beforePath string, afterPath string, description string) {
+	before, err := readSchemaDump(beforePath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	after, err := readSchemaDump(afterPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	doScript, undoScript := GenerateMigrationFromDiff(before, after)
+	if doScript == "" {
+		log.Fatalf("%s and %s describe the same schema", beforePath, afterPath)
+	}
+	newMigration(description, doScript, undoScript)
+}
+
+//DumpSchema prints the tables, columns and indexes of the database in the format
+//new --from-diff reads
+func DumpSchema() {
+	schema, err := CaptureSchema(getDb())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, line := range schema {
+		fmt.Println(line)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/joshkamau/pgmigrate
 
 go 1.18
 
-require github.com/lib/pq v1.10.5
+require github.com/lib/pq v1.10.9
@@ -0,0 +1,121 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//keepaliveDialer opens connections to the database with the configured TCP keepalive settings.
+//lib/pq does not understand libpq's keepalives parameters, so they are applied when dialing.
+type keepaliveDialer struct {
+	enabled  bool
+	idle     time.Duration
+	interval time.Duration
+}
+
+func (d keepaliveDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d keepaliveDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d keepaliveDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	//keepalives are configured below rather than with the dialer defaults
+	dialer := net.Dialer{KeepAlive: -1}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		//unix sockets have no keepalives
+		return conn, nil
+	}
+	err = d.configure(tcpConn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//configure applies the keepalive settings to a new connection
+func (d keepaliveDialer) configure(conn *net.TCPConn) error {
+	err := conn.SetKeepAlive(d.enabled)
+	if err != nil || !d.enabled {
+		return err
+	}
+	if d.idle > 0 {
+		err = conn.SetKeepAlivePeriod(d.idle)
+		if err != nil {
+			return err
+		}
+	}
+	if d.interval > 0 {
+		return setKeepaliveInterval(conn, d.interval)
+	}
+	return nil
+}
+
+//dialerConnector is a driver.Connector opening pq connections with a custom dialer
+type dialerConnector struct {
+	connector *pq.Connector
+}
+
+//newDialerConnector returns a dialerConnector for dsn dialing with dialer
+func newDialerConnector(dsn string, dialer pq.Dialer) (dialerConnector, error) {
+	if isDatabaseURL(dsn) {
+		var err error
+		dsn, err = parseDatabaseURL(dsn)
+		if err != nil {
+			return dialerConnector{}, err
+		}
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return dialerConnector{}, err
+	}
+	connector.Dialer(dialer)
+	return dialerConnector{connector: connector}, nil
+}
+
+//Connect opens a connection, giving up with ctx's error when ctx ends first. lib/pq dials
+//with ctx but does not watch it during the startup that follows, so a connection that
+//completes after ctx ended is closed.
+func (c dialerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		conn driver.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := c.connector.Connect(ctx)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (c dialerConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
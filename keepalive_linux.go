@@ -0,0 +1,25 @@
+//go:build linux
+
+package pgmigrate
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+//setKeepaliveInterval sets the time between keepalive probes after the first one
+func setKeepaliveInterval(conn *net.TCPConn, interval time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(interval/time.Second))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package pgmigrate
+
+import (
+	"net"
+	"time"
+)
+
+//setKeepaliveInterval is a no-op on platforms where the probe interval cannot be set
+//separately; probes are sent every keepalivesIdle seconds instead
+func setKeepaliveInterval(conn *net.TCPConn, interval time.Duration) error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package pgmigrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//TestConnectTimesOut checks that connecting to a server that never answers the startup
+//message gives up when the context's deadline passes
+func TestConnectTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	connector, err := newDialerConnector(fmt.Sprintf("host=127.0.0.1 port=%d user=app dbname=app sslmode=disable", addr.Port), keepaliveDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := connector.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Connect() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Connect() took %s, want it to give up at the deadline", elapsed)
+	}
+}
+
+//TestWaitForDbCanceled checks that the connect retries stop when the context is cancelled
+func TestWaitForDbCanceled(t *testing.T) {
+	m, fake := newTestMigrator(t, nil)
+	fake.connectErr = errors.New("connection refused")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	c := &Config{MaxConnectRetries: 10, ConnectRetryDelay: 1000}
+	if err := waitForDb(ctx, c, m.db); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForDb() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitForDb() took %s, want it to stop when cancelled", elapsed)
+	}
+}
@@ -0,0 +1,168 @@
+package pgmigrate
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//looseMarkerRe matches anything that looks like an attempt at a @DO or @UNDO marker
+var looseMarkerRe = regexp.MustCompile(`(?i)^\s*-*\s*@\s*(DO|UNDO)\b`)
+
+var limitRe = regexp.MustCompile(`(?i)\bLIMIT\b`)
+
+//LintMigration checks a single migration file and returns the problems found along
+//with advisory warnings
+func LintMigration(filename string, content string) (*Migration, []string, []string) {
+	var problems []string
+
+	m, err := parseMigration(filename, content)
+	if err != nil {
+		return nil, []string{err.Error()}, nil
+	}
+	if strings.TrimSpace(m.Description) == "" {
+		problems = append(problems, "missing description in file name")
+	}
+
+	doMarkers := 0
+	undoMarkers := 0
+	var state sqlState
+	for i, line := range strings.Split(content, "\n") {
+		if !state.quoted() {
+			switch {
+			case doMarkerRe.MatchString(line):
+				doMarkers++
+				if undoMarkers > 0 {
+					problems = append(problems, fmt.Sprintf("line %d: @DO marker after @UNDO marker", i+1))
+				}
+			case undoMarkerRe.MatchString(line):
+				undoMarkers++
+			case looseMarkerRe.MatchString(line):
+				problems = append(problems, fmt.Sprintf("line %d: malformed marker %q, expected \"-- @DO\" or \"-- @UNDO\"", i+1, strings.TrimSpace(line)))
+			}
+		}
+		state.scanLine(line)
+	}
+
+	switch {
+	case doMarkers == 0:
+		problems = append(problems, "missing -- @DO marker")
+	case doMarkers > 1:
+		problems = append(problems, "more than one -- @DO marker")
+	case isEmptyScript(m.DoScript):
+		problems = append(problems, "empty @DO script")
+	}
+	switch {
+	case undoMarkers == 0:
+		problems = append(problems, "missing -- @UNDO marker")
+	case undoMarkers > 1:
+		problems = append(problems, "more than one -- @UNDO marker")
+	}
+
+	warnings := lintDoScript(m.DoScript)
+	if undoMarkers == 1 && m.EmptyUndo() {
+		warnings = append(warnings, "empty @UNDO script, down will refuse to undo it without --force")
+	}
+	return m, problems, warnings
+}
+
+//lintDoScript warns about a DO script that mixes schema changes with bulk data changes,
+//which keeps locks taken by the DDL for as long as the data change runs
+func lintDoScript(script string) []string {
+	var ddl, dml string
+	for _, statement := range SplitStatements(script) {
+		switch keyword := statementKeyword(statement); keyword {
+		case "CREATE", "ALTER", "DROP":
+			if ddl == "" {
+				ddl = keyword
+			}
+		case "UPDATE", "DELETE":
+			if dml == "" && !limitRe.MatchString(statement) {
+				dml = keyword
+			}
+		}
+	}
+	if ddl != "" && dml != "" {
+		return []string{fmt.Sprintf("@DO mixes DDL (%s) with bulk DML (%s), consider splitting it into separate migrations", ddl, dml)}
+	}
+	return nil
+}
+
+//LintOptions controls how Lint reports problems
+type LintOptions struct {
+	//MaxErrors stops the check once this many problems have been found, 0 meaning no limit
+	MaxErrors int
+	//Strict treats warnings as problems
+	Strict bool
+}
+
+//Lint checks all migration files without connecting to the database and exits
+//with a non-zero status if any problem is found
+func Lint(opts LintOptions) {
+	maxErrors := opts.MaxErrors
+	strict := opts.Strict
+
+	files, errs, err := migrationFiles()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	count := 0
+	var problems []string
+	for _, err := range errs {
+		problems = append(problems, err.Error())
+	}
+	seen := make(map[int64]string)
+	for _, name := range files {
+		if maxErrors > 0 && len(problems) >= maxErrors {
+			break
+		}
+		count++
+		content, err := readMigrationContent(name)
+		if err == nil {
+			content, err = renderMigrationTemplate(name, content)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+
+		m, fileProblems, warnings := LintMigration(name, content)
+		if m != nil {
+			if other, ok := seen[m.Timestamp]; ok {
+				fileProblems = append(fileProblems, fmt.Sprintf("duplicate timestamp %d, also used by %s", m.Timestamp, other))
+			} else {
+				seen[m.Timestamp] = name
+			}
+		}
+		for _, p := range fileProblems {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, p))
+		}
+		for _, w := range warnings {
+			if strict {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, w))
+			} else {
+				fmt.Printf("%s: warning: %s\n", name, w)
+			}
+		}
+	}
+
+	if maxErrors > 0 && len(problems) >= maxErrors {
+		problems = problems[:maxErrors]
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		fmt.Printf("Stopped after %d problem(s), after checking %d migration(s)\n", len(problems), count)
+		os.Exit(1)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %d migration(s)\n", len(problems), count)
+		os.Exit(1)
+	}
+	fmt.Printf("%d migration(s) OK\n", count)
+}
@@ -0,0 +1,90 @@
+package pgmigrate
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+//lockPollInterval is how often a run waiting for the migration lock tries again
+const lockPollInterval = time.Second
+
+//lockKey is the advisory lock key of the changelog table, so that runs tracked in
+//different changelog tables, e.g. other streams, do not wait for each other
+func lockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(GetConfig().ChangelogTable()))
+	return int64(h.Sum64())
+}
+
+//acquireLock takes the postgres advisory lock that keeps two runs from changing the
+//database at once, waiting up to lockTimeout seconds for another run to release it. It
+//returns an error wrapping ErrConnect if the database cannot be reached and one wrapping
+//ErrLockHeld if the wait times out, and otherwise a function releasing the lock. The lock
+//is also released when the process exits.
+func acquireLock(ctx context.Context) (func(), error) {
+	if sqlOnly || dryRun {
+		return func() {}, nil
+	}
+	timeout := time.Duration(defaultLockTimeout) * time.Second
+	if c := GetConfig(); c.LockTimeout != nil {
+		timeout = time.Duration(*c.LockTimeout) * time.Second
+	}
+
+	//advisory locks belong to a session, so the lock is taken and released on one connection
+	pool, err := getDbContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, connectError(ctx, err)
+	}
+	key := lockKey()
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		var locked bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			conn.Close()
+			return nil, fmt.Errorf("%w: another migration is in progress, gave up after %s", ErrLockHeld, timeout)
+		}
+		if !waiting {
+			log.Println("Another migration is in progress, waiting for it to finish ...")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	return func() {
+		//the lock is released even if ctx was cancelled
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			log.Printf("Unable to release the migration lock: %v", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+//mustLock takes the migration lock, exiting if it cannot
+func mustLock(ctx context.Context) func() {
+	release, err := acquireLock(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return release
+}
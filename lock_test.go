@@ -0,0 +1,45 @@
+package pgmigrate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+//TestCancelledRunCleansUp checks that a run cancelled during a migration still resets the
+//search_path of its connection and releases the migration lock
+func TestCancelledRunCleansUp(t *testing.T) {
+	files := map[string]string{
+		"1_users_email_index.sql": "-- @SCHEMA app\n-- @NO_TRANSACTION\n-- @DO\nCREATE INDEX CONCURRENTLY users_email ON users (email);\n-- @UNDO\nDROP INDEX CONCURRENTLY users_email;\n",
+	}
+	m, fake := newTestMigrator(t, files)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.onExec = func(query string) error {
+		if strings.Contains(query, "CONCURRENTLY") {
+			cancel()
+			return errors.New("pq: canceling statement due to user request")
+		}
+		return nil
+	}
+
+	if err := m.Up(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Up() = %v, want %v", err, context.Canceled)
+	}
+	var reset, unlocked bool
+	for _, s := range fake.statements() {
+		switch s.query {
+		case "RESET search_path":
+			reset = true
+		case "SELECT pg_advisory_unlock($1)":
+			unlocked = true
+		}
+	}
+	if !reset {
+		t.Error("the search_path was not reset")
+	}
+	if !unlocked {
+		t.Error("the migration lock was not released")
+	}
+}
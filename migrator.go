@@ -0,0 +1,69 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+//Migrator runs the migrations in the config's scripts directory against a database, for
+//programs that migrate their database on startup instead of running the pgmigrate command.
+//pgmigrate keeps its state in package variables, so Migrators must not be used concurrently.
+type Migrator struct {
+	db     *sql.DB
+	config *Config
+}
+
+//New returns a Migrator for db, which it uses for the migrations and the changelog tables
+//without opening connections of its own. The connection settings of config, including
+//changelogDsn, are ignored and scriptsDir is relative to the working directory.
+func New(db *sql.DB, config *Config) (*Migrator, error) {
+	if db == nil {
+		return nil, errors.New("pgmigrate: db is required")
+	}
+	c := *config
+	c.ChangelogDsn = ""
+	if err := c.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if c.MigrationTableName == "" {
+		return nil, fmt.Errorf("pgmigrate: MigrationTableName is required")
+	}
+	return &Migrator{db: db, config: &c}, nil
+}
+
+//use makes the Migrator's database and config the ones the commands run with
+func (m *Migrator) use() {
+	db = m.db
+	conf = m.config
+}
+
+//Up applies up to n pending migrations in timestamp order, all of them if n is 0, and
+//stops at the first one that fails
+func (m *Migrator) Up(ctx context.Context, n int) error {
+	m.use()
+	_, err := up(ctx, UpOptions{N: int64(n)})
+	return err
+}
+
+//Down undoes the n most recently applied migrations, newest first
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	if n < 1 {
+		return fmt.Errorf("pgmigrate: cannot undo %d migrations", n)
+	}
+	m.use()
+	_, err := down(ctx, DownOptions{N: int64(n)})
+	return err
+}
+
+//Status returns every migration in the scripts directory in timestamp order, with
+//IsApplied set for those recorded in the changelog. Files that cannot be read are
+//reported in a FileErrors error returned along with the other migrations.
+func (m *Migrator) Status(ctx context.Context) (Migrations, error) {
+	m.use()
+	if err := connect(ctx); err != nil {
+		return nil, err
+	}
+	return readMigrationsFromFile(ctx)
+}
@@ -0,0 +1,235 @@
+package pgmigrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//TestMigratorConnectError checks that every Migrator method reports a database it cannot
+//reach with ErrConnect
+func TestMigratorConnectError(t *testing.T) {
+	files := map[string]string{
+		"1_users.sql": "-- @DO\nCREATE TABLE users (id int);\n-- @UNDO\nDROP TABLE users;\n",
+	}
+	m, fake := newTestMigrator(t, files)
+	fake.connectErr = errors.New("dial tcp 127.0.0.1:5432: connect: connection refused")
+	ctx := context.Background()
+
+	if err := m.Up(ctx, 0); !errors.Is(err, ErrConnect) {
+		t.Errorf("Up() = %v, want %v", err, ErrConnect)
+	}
+	if err := m.Down(ctx, 1); !errors.Is(err, ErrConnect) {
+		t.Errorf("Down() = %v, want %v", err, ErrConnect)
+	}
+	if _, err := m.Status(ctx); !errors.Is(err, ErrConnect) {
+		t.Errorf("Status() = %v, want %v", err, ErrConnect)
+	}
+}
+
+//TestMigratorConnectCanceled checks that a run canceled before it connects reports the
+//cancellation rather than ErrConnect
+func TestMigratorConnectCanceled(t *testing.T) {
+	m, _ := newTestMigrator(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := m.Up(ctx, 0)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrConnect) {
+		t.Errorf("Up() = %v, want %v", err, context.Canceled)
+	}
+}
+
+//threeMigrations creates the tables a, b and c, one per migration
+var threeMigrations = map[string]string{
+	"1_a.sql": "-- @DO\nCREATE TABLE a (id int);\n-- @UNDO\nDROP TABLE a;\n",
+	"2_b.sql": "-- @DO\nCREATE TABLE b (id int);\n-- @UNDO\nDROP TABLE b;\n",
+	"3_c.sql": "-- @DO\nCREATE TABLE c (id int);\n-- @UNDO\nDROP TABLE c;\n",
+}
+
+//TestMigratorUpN checks that up n applies the n oldest pending migrations in order, and all
+//of them when fewer are pending
+func TestMigratorUpN(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{1, []string{"CREATE TABLE a (id int);"}},
+		{2, []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);"}},
+		{5, []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);", "CREATE TABLE c (id int);"}},
+	}
+	for _, tt := range tests {
+		m, fake := newTestMigrator(t, threeMigrations)
+		if err := m.Up(context.Background(), tt.n); err != nil {
+			t.Fatalf("Up(%d) = %v", tt.n, err)
+		}
+		if got := fake.migrationStatements(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Up(%d) ran %q, want %q", tt.n, got, tt.want)
+		}
+		if applied := fake.appliedTimestamps(); len(applied) != len(tt.want) {
+			t.Errorf("Up(%d) recorded %d migration(s), want %d", tt.n, len(applied), len(tt.want))
+		}
+	}
+}
+
+//TestMigratorDownN checks that down n undoes the n newest applied migrations newest first,
+//all of them when fewer are applied, and that n must be at least 1
+func TestMigratorDownN(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{1, []string{"DROP TABLE c;"}},
+		{2, []string{"DROP TABLE c;", "DROP TABLE b;"}},
+		{5, []string{"DROP TABLE c;", "DROP TABLE b;", "DROP TABLE a;"}},
+	}
+	for _, tt := range tests {
+		m, fake := newTestMigrator(t, threeMigrations)
+		for _, timestamp := range []int64{1, 2, 3} {
+			fake.applied[timestamp] = ""
+		}
+		if err := m.Down(context.Background(), tt.n); err != nil {
+			t.Fatalf("Down(%d) = %v", tt.n, err)
+		}
+		if got := fake.migrationStatements(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Down(%d) ran %q, want %q", tt.n, got, tt.want)
+		}
+		if applied := fake.appliedTimestamps(); len(applied) != 3-len(tt.want) {
+			t.Errorf("Down(%d) left %d migration(s) applied, want %d", tt.n, len(applied), 3-len(tt.want))
+		}
+	}
+
+	m, fake := newTestMigrator(t, threeMigrations)
+	fake.applied[1] = ""
+	if err := m.Down(context.Background(), 0); err == nil {
+		t.Error("Down(0) succeeded, want an error")
+	}
+	if !fake.appliedTimestamps()[1] {
+		t.Error("Down(0) undid a migration")
+	}
+}
+
+//captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+//TestSQLOnly checks that --sql-only prints the scripts and changelog statements up would
+//run without sending the database anything
+func TestSQLOnly(t *testing.T) {
+	m, fake := newTestMigrator(t, threeMigrations)
+	SetOptions(Options{SQLOnly: true})
+
+	var err error
+	out := captureStdout(t, func() { err = m.Up(context.Background(), 0) })
+	if err != nil {
+		t.Fatalf("Up() = %v", err)
+	}
+	for _, want := range []string{"CREATE TABLE a (id int);", "CREATE TABLE c (id int);", `INSERT INTO "changelog" (timestamp, description, checksum, author) VALUES (3, 'c', `} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Up() printed %q, want it to contain %q", out, want)
+		}
+	}
+	if got := fake.statements(); len(got) != 0 {
+		t.Errorf("--sql-only sent %d statement(s) to the database, want none", len(got))
+	}
+}
+
+//TestDryRun checks that a dry run prints the script and changelog statement of each
+//migration up and down would run, read from the changelog, without sending the database
+//anything but SELECTs
+func TestDryRun(t *testing.T) {
+	m, fake := newTestMigrator(t, threeMigrations)
+	fake.applied[1] = ""
+	SetOptions(Options{DryRun: true})
+	ctx := context.Background()
+
+	var err error
+	out := captureStdout(t, func() { err = m.Up(ctx, 0) })
+	if err != nil {
+		t.Fatalf("Up() = %v", err)
+	}
+	var want strings.Builder
+	for _, name := range []string{"2_b.sql", "3_c.sql"} {
+		mig, err := parseMigration(name, threeMigrations[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&want, "BEGIN;\n\n%s\n\nINSERT INTO \"changelog\" (timestamp, description, checksum, author) VALUES (%d, '%s', '%s', NULL);\n\nCOMMIT;\n\n", strings.TrimSpace(mig.DoScript), mig.Timestamp, mig.Description, mig.Checksum())
+	}
+	if out != want.String() {
+		t.Errorf("Up() printed %q, want %q", out, want.String())
+	}
+
+	out = captureStdout(t, func() { err = m.Down(ctx, 2) })
+	if err != nil {
+		t.Fatalf("Down() = %v", err)
+	}
+	if want := "BEGIN;\n\nDROP TABLE a;\n\nDELETE FROM \"changelog\" WHERE timestamp = 1;\n\nCOMMIT;\n\n"; out != want {
+		t.Errorf("Down() printed %q, want %q", out, want)
+	}
+
+	statements := fake.statements()
+	if len(statements) == 0 {
+		t.Fatal("the changelog was not read")
+	}
+	for _, s := range statements {
+		if !strings.HasPrefix(s.query, "SELECT ") || strings.HasPrefix(s.query, "SELECT pg_") {
+			t.Errorf("dry run sent %q", s.query)
+		}
+	}
+	if applied := fake.appliedTimestamps(); len(applied) != 1 || !applied[1] {
+		t.Errorf("dry run changed the changelog to %v", applied)
+	}
+}
+
+//TestNoTransaction checks that a migration with a @NO_TRANSACTION header runs outside a
+//transaction, so it can build an index concurrently, and that one without it cannot
+func TestNoTransaction(t *testing.T) {
+	for _, header := range []string{"-- @NO_TRANSACTION", "-- @NO-TRANSACTION"} {
+		files := map[string]string{
+			"1_users_email_index.sql": header + "\n-- @DO\nCREATE INDEX CONCURRENTLY users_email ON users (email);\n-- @UNDO\nDROP INDEX CONCURRENTLY users_email;\n",
+		}
+		m, fake := newTestMigrator(t, files)
+		if err := m.Up(context.Background(), 0); err != nil {
+			t.Fatalf("%s: Up() = %v", header, err)
+		}
+		for _, s := range fake.statements() {
+			if strings.Contains(s.query, "CONCURRENTLY") && s.inTx {
+				t.Errorf("%s: %q ran in a transaction", header, s.query)
+			}
+		}
+		if !fake.appliedTimestamps()[1] {
+			t.Errorf("%s: the migration was not recorded", header)
+		}
+	}
+
+	files := map[string]string{
+		"1_users_email_index.sql": "-- @DO\nCREATE INDEX CONCURRENTLY users_email ON users (email);\n-- @UNDO\nDROP INDEX CONCURRENTLY users_email;\n",
+	}
+	m, fake := newTestMigrator(t, files)
+	if err := m.Up(context.Background(), 0); err == nil {
+		t.Error("Up() built an index concurrently in a transaction")
+	}
+	if len(fake.appliedTimestamps()) != 0 {
+		t.Error("the failed migration was recorded")
+	}
+}
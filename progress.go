@@ -0,0 +1,145 @@
+package pgmigrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+//ProgressEvent is a single line of --json-logs output
+type ProgressEvent struct {
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	Event       string    `json:"event"`
+	Timestamp   int64     `json:"timestamp"`
+	Description string    `json:"description"`
+	DurationMs  int64     `json:"durationMs"`
+	Error       string    `json:"error,omitempty"`
+}
+
+//emitProgress writes a progress event to stderr when --json-logs is set
+func emitProgress(e ProgressEvent) {
+	if !jsonLogs {
+		return
+	}
+	e.Time = time.Now()
+	err := json.NewEncoder(os.Stderr).Encode(e)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//runMigration runs step, the migration's Do or Undo, reporting its progress. If the step
+//fails it names the migration file and exits with status 1, so up and down stop at the
+//first failing migration. It returns how long the step took.
+func runMigration(ctx context.Context, command string, verb string, m *Migration, step func(context.Context) error) time.Duration {
+	elapsed, err := tryMigration(ctx, command, verb, m, step)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return elapsed
+}
+
+//tryMigration is runMigration returning an error naming the migration file instead of exiting
+func tryMigration(ctx context.Context, command string, verb string, m *Migration, step func(context.Context) error) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("migration interrupted before %s: %w", m.Filename, err)
+	}
+	if !jsonLogs {
+		log.Printf("%s %s ...", verb, m.Description)
+	}
+	emitProgress(ProgressEvent{Command: command, Event: "start", Timestamp: m.Timestamp, Description: m.Description})
+
+	start := time.Now()
+	err := step(ctx)
+	elapsed := time.Since(start)
+	duration := elapsed.Milliseconds()
+	//cause is the error without the MigrationError, the event already names the migration
+	cause := err
+	var migrationErr *MigrationError
+	if errors.As(err, &migrationErr) {
+		cause = migrationErr.Err
+	}
+	//a cancelled statement fails with an error of its own, ctx tells why it was cancelled
+	if err != nil && ctx.Err() != nil {
+		cause = ctx.Err()
+		if migrationErr != nil {
+			migrationErr.Err = cause
+		} else {
+			err = cause
+		}
+		emitProgress(ProgressEvent{Command: command, Event: "failure", Timestamp: m.Timestamp, Description: m.Description, DurationMs: duration, Error: cause.Error()})
+		if m.NoTransaction {
+			return elapsed, fmt.Errorf("migration interrupted, %s has @NO_TRANSACTION so the statements it completed were not rolled back: %w", m.Filename, err)
+		}
+		return elapsed, fmt.Errorf("migration interrupted, %s rolled back: %w", m.Filename, err)
+	}
+	if err != nil {
+		emitProgress(ProgressEvent{Command: command, Event: "failure", Timestamp: m.Timestamp, Description: m.Description, DurationMs: duration, Error: cause.Error()})
+		return elapsed, fmt.Errorf("%s %s: %w", verb, m.Filename, err)
+	}
+	emitProgress(ProgressEvent{Command: command, Event: "success", Timestamp: m.Timestamp, Description: m.Description, DurationMs: duration})
+	return elapsed, nil
+}
+
+//MigrationTiming is how long a single migration took in a RunSummary
+type MigrationTiming struct {
+	Timestamp   int64  `json:"timestamp"`
+	Description string `json:"description"`
+	DurationMs  int64  `json:"durationMs"`
+}
+
+//RunSummary is written by up --summary-json once every migration has been applied
+type RunSummary struct {
+	Applied    int               `json:"applied"`
+	DurationMs int64             `json:"durationMs"`
+	Migrations []MigrationTiming `json:"migrations"`
+	//Version is the timestamp of the latest applied migration, 0 if there is none
+	Version int64 `json:"version"`
+}
+
+//printTimings prints how long each migration took and the total time to stderr, so the
+//slow migration of a long run can be found. Nothing is printed if no migration ran or
+//with --json-logs, whose events carry the durations.
+func printTimings(verb string, timings []MigrationTiming, total time.Duration) {
+	if jsonLogs || len(timings) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, t := range timings {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", t.Timestamp, t.Description, formatDuration(time.Duration(t.DurationMs)*time.Millisecond))
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%s %d migration(s) in %s\n", verb, len(timings), formatDuration(total))
+}
+
+//formatDuration formats d as milliseconds below a second and to a tenth of a second above
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+//writeSummary writes the run summary as JSON to path, or to stdout if path is -
+func writeSummary(path string, summary RunSummary) {
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	summaryJSON = append(summaryJSON, '\n')
+	if path == "-" {
+		os.Stdout.Write(summaryJSON)
+		return
+	}
+	err = ioutil.WriteFile(path, summaryJSON, defaultFilePermission)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
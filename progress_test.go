@@ -0,0 +1,88 @@
+package pgmigrate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//TestTryMigrationKeepsMigrationError checks that the error of a failed migration matches
+//ErrMigrationFailed and holds the MigrationError and the error that caused it
+func TestTryMigrationKeepsMigrationError(t *testing.T) {
+	files := map[string]string{
+		"1_users.sql": "-- @DO\nCREATE TABLE users (id int);\n-- @UNDO\nDROP TABLE users;\n",
+	}
+	m, fake := newTestMigrator(t, files)
+	syntaxErr := errors.New(`pq: syntax error at or near "TABLE"`)
+	fake.onExec = func(query string) error {
+		return syntaxErr
+	}
+
+	err := m.Up(context.Background(), 0)
+	if !errors.Is(err, ErrMigrationFailed) {
+		t.Errorf("Up() = %v, want it to match ErrMigrationFailed", err)
+	}
+	if !errors.Is(err, syntaxErr) {
+		t.Errorf("Up() = %v, want it to wrap the statement's error", err)
+	}
+	var migrationErr *MigrationError
+	if !errors.As(err, &migrationErr) {
+		t.Fatalf("Up() = %v, want a MigrationError", err)
+	}
+	if migrationErr.Migration.Timestamp != 1 {
+		t.Errorf("MigrationError is for migration %d, want 1", migrationErr.Migration.Timestamp)
+	}
+}
+
+//TestTryMigrationCanceled checks that a migration failing because the run was canceled
+//reports the cancellation, still as a MigrationError
+func TestTryMigrationCanceled(t *testing.T) {
+	files := map[string]string{
+		"1_users.sql": "-- @DO\nCREATE TABLE users (id int);\n-- @UNDO\nDROP TABLE users;\n",
+	}
+	m, fake := newTestMigrator(t, files)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.onExec = func(query string) error {
+		cancel()
+		return errors.New("pq: canceling statement due to user request")
+	}
+
+	err := m.Up(ctx, 0)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrMigrationFailed) {
+		t.Errorf("Up() = %v, want it to match context.Canceled and ErrMigrationFailed", err)
+	}
+}
+
+//TestCancelBetweenStatements checks that a run cancelled after a statement of a migration
+//succeeded sends no more statements, rolls the migration back and reports it
+func TestCancelBetweenStatements(t *testing.T) {
+	files := map[string]string{
+		"1_users.sql":  "-- @DO\nCREATE TABLE users (id int);\nCREATE INDEX users_id ON users (id);\n-- @UNDO\nDROP TABLE users;\n",
+		"2_orders.sql": "-- @DO\nCREATE TABLE orders (id int);\n-- @UNDO\nDROP TABLE orders;\n",
+	}
+	m, fake := newTestMigrator(t, files)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.onExec = func(query string) error {
+		//the first statement succeeds, then the run is interrupted
+		cancel()
+		return nil
+	}
+
+	err := m.Up(ctx, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Up() = %v, want %v", err, context.Canceled)
+	}
+	if !strings.Contains(err.Error(), "migration interrupted, 1_users.sql rolled back") {
+		t.Errorf("Up() = %v, want it to say 1_users.sql was rolled back", err)
+	}
+	if got := fake.migrationStatements(); !reflect.DeepEqual(got, []string{"CREATE TABLE users (id int);"}) {
+		t.Errorf("ran %q after the run was cancelled", got)
+	}
+	if applied := fake.appliedTimestamps(); len(applied) != 0 {
+		t.Errorf("recorded %v as applied", applied)
+	}
+}
@@ -0,0 +1,93 @@
+package pgmigrate
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Rebase renumbers pending migrations that are older than the latest applied migration so
+//they sort after every existing migration. Applied migrations are never renamed.
+//Unless yes is set the plan is shown and confirmation is asked for.
+func Rebase(yes bool) {
+	migrations := ReadMigrationsFromFile()
+
+	var latestApplied, latest int64
+	for _, m := range migrations {
+		if m.IsApplied && m.Timestamp > latestApplied {
+			latestApplied = m.Timestamp
+		}
+		if m.Timestamp > latest {
+			latest = m.Timestamp
+		}
+	}
+
+	type rename struct {
+		from string
+		to   string
+	}
+	var plan []rename
+	now := time.Now()
+	for _, m := range migrations {
+		if m.IsApplied || m.Timestamp >= latestApplied {
+			continue
+		}
+		latest = timestampAfter(MigrationsDir(), latest, now)
+		oldTimestamp := strconv.FormatInt(m.Timestamp, 10)
+		newTimestamp := strconv.FormatInt(latest, 10)
+		plan = append(plan, rename{from: m.Filename, to: strings.Replace(m.Filename, oldTimestamp, newTimestamp, 1)})
+		//the .down.sql file of a split migration moves with it
+		if down := downFilename(m.Filename); down != "" {
+			if _, err := os.Stat(MigrationsDir() + down); err == nil {
+				plan = append(plan, rename{from: down, to: strings.Replace(down, oldTimestamp, newTimestamp, 1)})
+			}
+		}
+	}
+
+	if len(plan) == 0 {
+		fmt.Println("No pending migrations are older than the latest applied migration.")
+		return
+	}
+
+	fmt.Printf("Latest applied migration is %d. The following pending migrations will be renamed:\n", latestApplied)
+	for _, r := range plan {
+		fmt.Printf("  %s -> %s\n", r.from, r.to)
+	}
+	if !yes {
+		fmt.Print("Continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	for _, r := range plan {
+		to := MigrationsDir() + r.to
+		if _, err := os.Stat(to); err == nil {
+			log.Fatalf("Unable to rename %s, %s already exists", r.from, r.to)
+		}
+		err := os.Rename(MigrationsDir()+r.from, to)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Renamed %s -> %s\n", r.from, r.to)
+	}
+}
+
+//timestampAfter returns the newTimestamp for a migration created at now in dir, moved
+//past after when after is not older, so renumbered migrations keep valid YYYYMMDDHHMMSS
+//timestamps that increase one after another
+func timestampAfter(dir string, after int64, now time.Time) int64 {
+	t := now
+	//older migrations may have unix timestamps, which sort before any new one
+	if last, err := time.Parse(timestampFormat, strconv.FormatInt(after, 10)); err == nil && !last.Before(now.UTC()) {
+		t = last.Add(time.Second)
+	}
+	return newTimestamp(dir, t)
+}
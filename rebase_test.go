@@ -0,0 +1,31 @@
+package pgmigrate
+
+import (
+	"testing"
+	"time"
+)
+
+//TestTimestampAfter checks that renumbered migrations get valid timestamps, rolling the
+//seconds over into the next minute, hour and day
+func TestTimestampAfter(t *testing.T) {
+	now := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		after int64
+		want  []int64
+	}{
+		{20231114221358, []int64{20231114221359, 20231114221400, 20231114221401}},
+		{20231231235959, []int64{20240101000000, 20240101000001}},
+		{20231114215959, []int64{20231114220000, 20231114220001}},
+		{1699999999, []int64{20231114220000, 20231114220001}},
+	}
+	for _, tt := range tests {
+		after := tt.after
+		for _, want := range tt.want {
+			got := timestampAfter(t.TempDir(), after, now)
+			if got != want {
+				t.Errorf("timestampAfter(%d) = %d, want %d", after, got, want)
+			}
+			after = got
+		}
+	}
+}
@@ -7,7 +7,7 @@ rm -rvf ./data
 mkdir ./data
 
 #build
-go build
+go build ./cmd/pgmigrate
 
 #run
 ./pgmigrate init ./data
@@ -0,0 +1,164 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+//queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+const userSchemasFilter = "n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%' AND n.nspname NOT LIKE 'pg_temp%'"
+
+//schemaQueries select the schema objects, one tab separated line per object
+var schemaQueries = []string{
+	`SELECT 'table' || E'\t' || n.nspname || '.' || c.relname
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'p') AND ` + userSchemasFilter,
+
+	`SELECT 'column' || E'\t' || n.nspname || '.' || c.relname || E'\t' || a.attname || E'\t' ||
+		format_type(a.atttypid, a.atttypmod) || E'\t' ||
+		CASE WHEN a.attnotnull THEN 'NOT NULL' ELSE 'NULL' END || E'\t' ||
+		COALESCE(pg_get_expr(d.adbin, d.adrelid), '')
+	FROM pg_attribute a
+	JOIN pg_class c ON c.oid = a.attrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+	WHERE c.relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped AND ` + userSchemasFilter,
+
+	`SELECT 'index' || E'\t' || n.nspname || '.' || t.relname || E'\t' || i.relname || E'\t' || pg_get_indexdef(i.oid)
+	FROM pg_index x
+	JOIN pg_class i ON i.oid = x.indexrelid
+	JOIN pg_class t ON t.oid = x.indrelid
+	JOIN pg_namespace n ON n.oid = t.relnamespace
+	WHERE ` + userSchemasFilter,
+}
+
+//CaptureSchema describes the tables, columns and indexes in every user schema as a
+//sorted list of tab separated lines
+func CaptureSchema(q queryer) ([]string, error) {
+	var schema []string
+	for _, query := range schemaQueries {
+		rows, err := q.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var line string
+			if err = rows.Scan(&line); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			schema = append(schema, line)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(schema)
+	return schema, nil
+}
+
+//DiffSchema returns the lines removed from and added to the before schema to get the after schema
+func DiffSchema(before []string, after []string) (removed []string, added []string) {
+	inBefore := make(map[string]bool)
+	for _, line := range before {
+		inBefore[line] = true
+	}
+	inAfter := make(map[string]bool)
+	for _, line := range after {
+		inAfter[line] = true
+		if !inBefore[line] {
+			added = append(added, line)
+		}
+	}
+	for _, line := range before {
+		if !inAfter[line] {
+			removed = append(removed, line)
+		}
+	}
+	return removed, added
+}
+
+//Preview applies a migration to the shadow database inside a transaction that is
+//rolled back, and prints the schema changes it made. The @DO script runs the way up runs
+//it, a statement at a time with the migration's @SCHEMA and @IDEMPOTENT handling.
+//@NO_TRANSACTION migrations cannot be previewed since they cannot be rolled back.
+func Preview(timestamp int64, shadowDsn string) {
+	if shadowDsn == "" {
+		shadowDsn = GetConfig().ShadowDsn
+	}
+	if shadowDsn == "" {
+		log.Fatalln("preview needs a scratch database, set shadowDsn in pgmigrate.json or pass --shadow-dsn")
+	}
+
+	m := findMigration(timestamp)
+	if m == nil {
+		log.Fatalf("No migration with timestamp %d", timestamp)
+	}
+	if m.NoTransaction {
+		log.Fatalf("Cannot preview %s, its @NO_TRANSACTION statements cannot run in the transaction preview rolls back", m.Filename)
+	}
+
+	shadow, err := sql.Open("postgres", shadowDsn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer shadow.Close()
+	tx, err := shadow.Begin()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	//nothing done in the shadow database is ever kept
+	defer tx.Rollback()
+
+	before, err := CaptureSchema(tx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = execScriptInTx(context.Background(), tx, m, searchPathSQL(m), m.DoScript)
+	if err != nil {
+		log.Fatalf("Applying %s to the shadow database failed: %v", m.Description, err)
+	}
+	after, err := CaptureSchema(tx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	removed, added := DiffSchema(before, after)
+	if len(removed) == 0 && len(added) == 0 {
+		fmt.Println("No schema changes.")
+		return
+	}
+	for _, line := range removed {
+		fmt.Println("- " + strings.Replace(line, "\t", " ", -1))
+	}
+	for _, line := range added {
+		fmt.Println("+ " + strings.Replace(line, "\t", " ", -1))
+	}
+}
+
+//findMigration reads the migration with the given timestamp, or returns nil if there is none
+func findMigration(timestamp int64) *Migration {
+	files, _, err := migrationFiles()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, name := range files {
+		m, err := loadMigration(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if m.Timestamp == timestamp {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package pgmigrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//changelogRow is a changelog row as stored in a snapshot
+type changelogRow struct {
+	Timestamp   int64      `json:"timestamp"`
+	Description string     `json:"description"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty"`
+	Checksum    *string    `json:"checksum,omitempty"`
+	Author      *string    `json:"author,omitempty"`
+}
+
+//SnapshotChangelog serializes the rows of the changelog so RestoreChangelog can put the
+//changelog back the way it was, e.g. between tests that share a database. A missing
+//changelog table gives an empty snapshot.
+func SnapshotChangelog() ([]byte, error) {
+	c := GetConfig()
+	query := fmt.Sprintf("SELECT %s, description, applied_at, checksum, author FROM %s ORDER BY id", c.TimestampColumn(), c.quotedChangelogTable())
+	rows, err := getChangelogDb().Query(query)
+	if err != nil {
+		if isUndefinedTable(err) {
+			return json.Marshal([]changelogRow{})
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshot := []changelogRow{}
+	for rows.Next() {
+		var r changelogRow
+		if err = rows.Scan(&r.Timestamp, &r.Description, &r.AppliedAt, &r.Checksum, &r.Author); err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshot)
+}
+
+//RestoreChangelog replaces the rows of the changelog with the ones in a snapshot taken by
+//SnapshotChangelog. Only the changelog is restored, not the schema the migrations created.
+func RestoreChangelog(snapshot []byte) error {
+	var rows []changelogRow
+	if err := json.Unmarshal(snapshot, &rows); err != nil {
+		return err
+	}
+
+	c := GetConfig()
+	if err := createChangeLogTable(context.Background()); err != nil {
+		return err
+	}
+	tx, err := getChangelogDb().Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", c.quotedChangelogTable()))
+	insertSQL := fmt.Sprintf("INSERT INTO %s (timestamp, description, applied_at, checksum, author) VALUES ($1, $2, $3, $4, $5)", c.quotedChangelogTable())
+	for _, r := range rows {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(insertSQL, r.Timestamp, r.Description, r.AppliedAt, r.Checksum, r.Author)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
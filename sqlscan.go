@@ -0,0 +1,123 @@
+package pgmigrate
+
+import (
+	"regexp"
+	"strings"
+)
+
+var dollarTagRe = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+//sqlState tracks whether a position in a SQL script falls inside a string literal, a
+//quoted identifier, a block comment or a dollar-quoted body such as a function definition
+type sqlState struct {
+	inString   bool
+	inIdent    bool
+	blockDepth int
+	dollarTag  string
+}
+
+//quoted reports whether the scanner is inside a literal, comment or dollar-quoted body
+func (s *sqlState) quoted() bool {
+	return s.inString || s.inIdent || s.blockDepth > 0 || s.dollarTag != ""
+}
+
+//scanLine advances the state past a single line of SQL and returns the positions of the
+//semicolons on the line that terminate a statement
+func (s *sqlState) scanLine(line string) []int {
+	var ends []int
+	for i := 0; i < len(line); i++ {
+		switch {
+		case s.dollarTag != "":
+			if strings.HasPrefix(line[i:], s.dollarTag) {
+				i += len(s.dollarTag) - 1
+				s.dollarTag = ""
+			}
+		case s.blockDepth > 0:
+			//block comments nest in postgres
+			if strings.HasPrefix(line[i:], "*/") {
+				s.blockDepth--
+				i++
+			} else if strings.HasPrefix(line[i:], "/*") {
+				s.blockDepth++
+				i++
+			}
+		case s.inString:
+			//an escaped quote ('') closes and immediately reopens the literal
+			if line[i] == '\'' {
+				s.inString = false
+			}
+		case s.inIdent:
+			if line[i] == '"' {
+				s.inIdent = false
+			}
+		case strings.HasPrefix(line[i:], "--"):
+			return ends
+		case line[i] == ';':
+			ends = append(ends, i)
+		case strings.HasPrefix(line[i:], "/*"):
+			s.blockDepth++
+			i++
+		case line[i] == '\'':
+			s.inString = true
+		case line[i] == '"':
+			s.inIdent = true
+		case line[i] == '$' && (i == 0 || !isIdentChar(line[i-1])):
+			if tag := dollarTagRe.FindString(line[i:]); tag != "" {
+				s.dollarTag = tag
+				i += len(tag) - 1
+			}
+		}
+	}
+	return ends
+}
+
+//SplitStatements splits a script into its statements, keeping semicolons that appear in
+//string literals, comments and dollar-quoted bodies. Statements keep their terminating
+//semicolon and any text after the last semicolon is returned as a final statement.
+func SplitStatements(script string) []string {
+	var statements []string
+	var state sqlState
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		start := 0
+		for _, end := range state.scanLine(line) {
+			current.WriteString(line[start : end+1])
+			statements = append(statements, current.String())
+			current.Reset()
+			start = end + 1
+		}
+		current.WriteString(line[start:])
+		current.WriteString("\n")
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		statements = append(statements, current.String())
+	}
+	return statements
+}
+
+var leadingCommentRe = regexp.MustCompile(`^(\s+|--[^\n]*|/\*(?s:.*?)\*/)+`)
+
+//statementKeyword returns the first keyword of a statement in upper case, skipping leading comments
+func statementKeyword(statement string) string {
+	statement = leadingCommentRe.ReplaceAllString(statement, "")
+	end := 0
+	for end < len(statement) && isIdentChar(statement[end]) {
+		end++
+	}
+	return strings.ToUpper(statement[:end])
+}
+
+//isEmptyScript checks if a script holds no statements, only whitespace and comments
+func isEmptyScript(script string) bool {
+	for _, statement := range SplitStatements(script) {
+		if statementKeyword(statement) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+//isIdentChar checks if c can be part of an unquoted identifier
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
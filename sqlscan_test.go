@@ -0,0 +1,94 @@
+package pgmigrate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//TestSplitStatements checks that scripts are split on the semicolons ending statements and
+//not on those inside literals, quoted identifiers, comments and dollar-quoted bodies
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "table and rows",
+			script: "CREATE TABLE users (id int, name text);\nINSERT INTO users VALUES (1, 'ann');\nINSERT INTO users VALUES (2, 'bob');\n",
+			want:   []string{"CREATE TABLE users (id int, name text);", "INSERT INTO users VALUES (1, 'ann');", "INSERT INTO users VALUES (2, 'bob');"},
+		},
+		{
+			name:   "quoted semicolons",
+			script: "INSERT INTO notes VALUES ('a;b', 'it''s;here');\nCREATE TABLE \"odd;name\" (id int);",
+			want:   []string{"INSERT INTO notes VALUES ('a;b', 'it''s;here');", "CREATE TABLE \"odd;name\" (id int);"},
+		},
+		{
+			name:   "comments",
+			script: "-- drop it; later\nSELECT 1; /* not; here */ SELECT 2;",
+			want:   []string{"-- drop it; later\nSELECT 1;", "/* not; here */ SELECT 2;"},
+		},
+		{
+			name:   "dollar-quoted function",
+			script: "CREATE FUNCTION one() RETURNS int AS $$\nBEGIN\n    RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;\nSELECT one();",
+			want:   []string{"CREATE FUNCTION one() RETURNS int AS $$\nBEGIN\n    RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;", "SELECT one();"},
+		},
+		{
+			name:   "tagged dollar quote",
+			script: "DO $body$\nBEGIN\n    EXECUTE $$SELECT 1;$$;\nEND;\n$body$;\nSELECT 2;",
+			want:   []string{"DO $body$\nBEGIN\n    EXECUTE $$SELECT 1;$$;\nEND;\n$body$;", "SELECT 2;"},
+		},
+		{
+			name:   "no final semicolon",
+			script: "SELECT 1;\nSELECT 2\n",
+			want:   []string{"SELECT 1;", "SELECT 2"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, statement := range SplitStatements(tt.script) {
+			got = append(got, strings.TrimSpace(statement))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: SplitStatements() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+//TestMigrationStatementsRunSeparately checks that each statement of a migration is sent
+//on its own, inside the migration's transaction
+func TestMigrationStatementsRunSeparately(t *testing.T) {
+	files := map[string]string{
+		"1_users.sql": `-- @DO
+CREATE TABLE users (id int, name text);
+INSERT INTO users VALUES (1, 'a;b');
+CREATE FUNCTION user_count() RETURNS bigint AS $$
+BEGIN
+    RETURN (SELECT count(*) FROM users);
+END;
+$$ LANGUAGE plpgsql;
+-- @UNDO
+DROP FUNCTION user_count();
+DROP TABLE users;
+`,
+	}
+	m, fake := newTestMigrator(t, files)
+	if err := m.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CREATE TABLE users (id int, name text);",
+		"INSERT INTO users VALUES (1, 'a;b');",
+		"CREATE FUNCTION user_count() RETURNS bigint AS $$\nBEGIN\n    RETURN (SELECT count(*) FROM users);\nEND;\n$$ LANGUAGE plpgsql;",
+	}
+	if got := fake.migrationStatements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	for _, s := range fake.statements() {
+		if !isBookkeeping(s.query) && !s.inTx {
+			t.Errorf("%q ran outside the migration's transaction", s.query)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package pgmigrate
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//Stamp is the migration state stored in the comment of the changelog table, so that a
+//pg_dump of the database carries it along
+type Stamp struct {
+	Applied   []int64   `json:"applied"`
+	StampedAt time.Time `json:"stampedAt"`
+}
+
+//StampComment stores the timestamps of the applied migrations as JSON in the comment
+//of the changelog table
+func StampComment() {
+	c := GetConfig()
+	applied := AppliedTimestamps()
+	stamp := Stamp{Applied: []int64{}, StampedAt: time.Now().UTC()}
+	for timestamp := range applied {
+		stamp.Applied = append(stamp.Applied, timestamp)
+	}
+	sort.Slice(stamp.Applied, func(i, j int) bool { return stamp.Applied[i] < stamp.Applied[j] })
+	stampJSON, err := json.Marshal(stamp)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	//COMMENT ON does not take parameters
+	query := fmt.Sprintf("COMMENT ON TABLE %s IS %s", c.quotedChangelogTable(), pq.QuoteLiteral(string(stampJSON)))
+	if sqlOnly {
+		printSQL(query)
+		return
+	}
+	if _, err = getChangelogDb().Exec(query); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Stamped %s with %d applied migration(s)", c.ChangelogTable(), len(stamp.Applied))
+}
+
+//ReadStamp prints the migration state stored in the comment of the changelog table by
+//stamp-comment, e.g. in a database restored from a dump
+func ReadStamp() {
+	c := GetConfig()
+	var comment sql.NullString
+	err := getChangelogDb().QueryRow("SELECT obj_description(to_regclass($1), 'pg_class')", c.ChangelogTable()).Scan(&comment)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !comment.Valid {
+		log.Fatalf("%s has no stamp, run 'pgmigrate stamp-comment' first", c.ChangelogTable())
+	}
+
+	var stamp Stamp
+	if err = json.Unmarshal([]byte(comment.String), &stamp); err != nil {
+		log.Fatalf("Invalid stamp on %s: %v", c.ChangelogTable(), err)
+	}
+	fmt.Printf("Stamped at %s with %d applied migration(s)\n", stamp.StampedAt.Format(time.RFC3339), len(stamp.Applied))
+	for _, timestamp := range stamp.Applied {
+		fmt.Println(timestamp)
+	}
+}